@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikdubbelboer/hench/internal/histogram"
+)
+
+// A distributed run works as follows:
+//
+//  1. The coordinator (hench run -agents=...) connects to every agent and
+//     sends an agentRun with the script and the flags for that agent.
+//  2. The agent starts hench with -stream as a child process which sets up
+//     the run and reports it's ready.
+//  3. When all agents are ready the coordinator sends the start command to
+//     all of them at once.
+//  4. Every second the child sends a sample and at the end its statistics.
+//     The agent passes these on to the coordinator which merges them.
+//
+// The coordinator and agents talk using JSON lines over TCP.
+//
+// Only the script and the files of the TLS flags are sent to the agents.
+// Modules loaded using require, feeder files and request body files are
+// opened by the agent, so agents need the same files at the same paths
+// relative to the directory they are started in.
+//
+// Agents run any script they are sent, and scripts can run commands using
+// os.execute, so every run has to include the token the agent was started
+// with.
+
+// The file descriptor a child process writes its records to. Stdout is left
+// for the script.
+const streamFd = 3
+
+var (
+	// When running as the child of an agent records are written here.
+	stream     *json.Encoder
+	streamLock sync.Mutex
+
+	// The fraction of the total rate this process generates.
+	rateShare = float64(1)
+)
+
+// agentRun is sent by the coordinator to start a run on an agent.
+type agentRun struct {
+	Token  string   `json:"token"`
+	Script string   `json:"script"`
+	Flags  []string `json:"flags"`
+	Args   []string `json:"args"`
+
+	// The contents of the files of the flags in fileFlags by flag name.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// Flags with files that are sent to the agents with the run.
+var fileFlags = []string{"cert", "key", "cacert"}
+
+// The format of the time the log package adds to every line.
+const logTime = "2006/01/02 15:04:05 "
+
+// lastLine is a writer that remembers the last line written to it that
+// isn't indented or part of a stack trace, which is the start of the last
+// error message.
+type lastLine struct {
+	m       sync.Mutex
+	partial []byte
+	line    string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.partial = append(l.partial, p...)
+
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(l.partial[:i]), " \r")
+		if line != "" && line != "stack traceback:" && line[0] != ' ' && line[0] != '\t' {
+			// Without the time added by the log package.
+			if len(line) > len(logTime) {
+				if _, err := time.Parse(logTime, line[:len(logTime)]); err == nil {
+					line = line[len(logTime):]
+				}
+			}
+
+			l.line = line
+		}
+
+		l.partial = l.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (l *lastLine) String() string {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.line
+}
+
+// agentCommand is sent by the coordinator to start or stop the run or to
+// change the rate.
+type agentCommand struct {
+	Command string  `json:"command"`
+	Rate    float64 `json:"rate,omitempty"` // The total rate of all agents.
+}
+
+// agentRecord is sent by an agent to the coordinator.
+type agentRecord struct {
+	Ready bool   `json:"ready,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Every second.
+	Sample    *sample           `json:"sample,omitempty"`
+	Latencies *histogram.Counts `json:"latencies,omitempty"`
+
+	// At the end of the run.
+	Stats *agentStats `json:"stats,omitempty"`
+}
+
+// agentStats contains the statistics of an agent at the end of the run.
+type agentStats struct {
+	Duration     float64 `json:"duration"`
+	Late         uint64  `json:"late"`
+	Dropped      uint64  `json:"dropped"`
+	ServerClosed uint64  `json:"server_closed"`
+
+	Counters  countersData                `json:"counters"`
+	Latencies histogram.Counts            `json:"latencies"`
+	Phases    [numPhases]histogram.Counts `json:"phases"`
+	IdleTimes histogram.Counts            `json:"idle_times"`
+	Tags      map[string]agentGroup       `json:"tags"`
+	Remotes   map[string]agentGroup       `json:"remotes"`
+}
+
+// countersData contains the counters in a form that can be encoded.
+type countersData struct {
+	Total          uint64            `json:"total"`
+	Requests       uint64            `json:"requests"`
+	Errors         uint64            `json:"errors"`
+	Status         map[int]uint64    `json:"status"`
+	Protos         map[string]uint64 `json:"protos"`
+	ErrorClasses   map[string]uint64 `json:"error_classes"`
+	NewConns       uint64            `json:"new_conns"`
+	ReusedConns    uint64            `json:"reused_conns"`
+	TLSHandshakes  uint64            `json:"tls_handshakes"`
+	TLSResumed     uint64            `json:"tls_resumed"`
+	QUICHandshakes uint64            `json:"quic_handshakes"`
+	ZeroRTT        uint64            `json:"zero_rtt"`
+	UploadBytes    uint64            `json:"upload_bytes"`
+	UploadTime     time.Duration     `json:"upload_time"`
+}
+
+func (c *counters) data() countersData {
+	return countersData{
+		Total:          c.total,
+		Requests:       c.requests,
+		Errors:         c.errors,
+		Status:         c.status,
+		Protos:         c.protos,
+		ErrorClasses:   c.errorClasses,
+		NewConns:       c.newConns,
+		ReusedConns:    c.reusedConns,
+		TLSHandshakes:  c.tlsHandshakes,
+		TLSResumed:     c.tlsResumed,
+		QUICHandshakes: c.quicHandshakes,
+		ZeroRTT:        c.zeroRTT,
+		UploadBytes:    c.uploadBytes,
+		UploadTime:     c.uploadTime,
+	}
+}
+
+func (c *counters) merge(d countersData) {
+	c.total += d.Total
+	c.requests += d.Requests
+	c.errors += d.Errors
+	c.newConns += d.NewConns
+	c.reusedConns += d.ReusedConns
+	c.tlsHandshakes += d.TLSHandshakes
+	c.tlsResumed += d.TLSResumed
+	c.quicHandshakes += d.QUICHandshakes
+	c.zeroRTT += d.ZeroRTT
+	c.uploadBytes += d.UploadBytes
+	c.uploadTime += d.UploadTime
+
+	for k, n := range d.Status {
+		c.status[k] += n
+	}
+	for k, n := range d.Protos {
+		c.protos[k] += n
+	}
+	for k, n := range d.ErrorClasses {
+		c.errorClasses[k] += n
+	}
+}
+
+type agentGroup struct {
+	Counters  countersData     `json:"counters"`
+	Latencies histogram.Counts `json:"latencies"`
+}
+
+func newAgentGroups(groups map[string]*tagStats) map[string]agentGroup {
+	g := make(map[string]agentGroup, len(groups))
+
+	for name, t := range groups {
+		g[name] = agentGroup{
+			Counters:  t.counters.data(),
+			Latencies: t.latencies.Counts(),
+		}
+	}
+
+	return g
+}
+
+// newAgentStats returns the statistics to send to the coordinator.
+func newAgentStats(st *stats) *agentStats {
+	a := &agentStats{
+		Counters:  st.counters.data(),
+		Latencies: st.latencies.Counts(),
+		IdleTimes: st.idleTimes.Counts(),
+		Tags:      newAgentGroups(st.tags),
+		Remotes:   newAgentGroups(st.remotes),
+	}
+
+	for i, h := range st.phases {
+		a.Phases[i] = h.Counts()
+	}
+
+	return a
+}
+
+// merge adds the statistics of an agent.
+func (s *stats) merge(a *agentStats) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.counters.merge(a.Counters)
+
+	if err := s.latencies.AddCounts(a.Latencies); err != nil {
+		return err
+	}
+	if err := s.idleTimes.AddCounts(a.IdleTimes); err != nil {
+		return err
+	}
+
+	for i, c := range a.Phases {
+		if err := s.phases[i].AddCounts(c); err != nil {
+			return err
+		}
+	}
+
+	for _, g := range []struct {
+		groups map[string]*tagStats
+		agent  map[string]agentGroup
+	}{
+		{s.tags, a.Tags},
+		{s.remotes, a.Remotes},
+	} {
+		for name, ag := range g.agent {
+			t := s.group(g.groups, name)
+
+			t.counters.merge(ag.Counters)
+
+			if err := t.latencies.AddCounts(ag.Latencies); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendRecord sends a record to the agent when running as its child.
+func sendRecord(r agentRecord) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	if err := stream.Encode(r); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// waitForStart tells the agent the run is ready to start and waits for the
+// start command. It returns the decoder to read the other commands from.
+func waitForStart() *json.Decoder {
+	sendRecord(agentRecord{Ready: true})
+
+	dec := json.NewDecoder(os.Stdin)
+
+	for {
+		var c agentCommand
+		if err := dec.Decode(&c); err != nil {
+			log.Fatal(err)
+		}
+
+		if c.Command == "start" {
+			return dec
+		}
+	}
+}
+
+// agentCommands handles the commands the agent passes on during the run.
+func agentCommands(dec *json.Decoder) {
+	for {
+		var c agentCommand
+		if err := dec.Decode(&c); err != nil {
+			return
+		}
+
+		switch c.Command {
+		case "stop":
+			stopRun()
+		case "rate":
+			rate.Set(c.Rate*rateShare, time.Second)
+		}
+	}
+}
+
+// agentMain runs hench as an agent that performs runs for a coordinator.
+func agentMain(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "Address to listen on for coordinators")
+	token := flags.String("token", os.Getenv("HENCH_AGENT_TOKEN"),
+		"Secret coordinators have to send to start a run (defaults to $HENCH_AGENT_TOKEN)")
+	flags.Parse(args)
+
+	if *token == "" {
+		log.Fatal("a -token is required as agents run the scripts they are sent")
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("agent listening on %s", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go serveAgent(conn, *token)
+	}
+}
+
+// serveAgent performs a run for the coordinator connected on conn if it
+// sent the token.
+func serveAgent(conn net.Conn, token string) {
+	defer conn.Close()
+
+	log.Printf("coordinator %s connected", conn.RemoteAddr())
+	defer log.Printf("coordinator %s done", conn.RemoteAddr())
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	var run agentRun
+	if err := dec.Decode(&run); err != nil {
+		log.Print(err)
+		return
+	}
+
+	fail := func(err error) {
+		log.Print(err)
+		enc.Encode(agentRecord{Error: err.Error()})
+	}
+
+	if subtle.ConstantTimeCompare([]byte(run.Token), []byte(token)) != 1 {
+		fail(errors.New("invalid token"))
+		return
+	}
+
+	args := append(run.Flags, "-stream")
+
+	// Without a script the child uses the default script.
+	if run.Script != "" {
+		name, err := writeTemp("hench-*.lua", run.Script)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer os.Remove(name)
+
+		args = append(args, "-script", name)
+	}
+
+	for _, f := range fileFlags {
+		content, ok := run.Files[f]
+		if !ok {
+			continue
+		}
+
+		name, err := writeTemp("hench-*.pem", content)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer os.Remove(name)
+
+		args = append(args, "-"+f+"="+name)
+	}
+
+	args = append(args, run.Args...)
+
+	executable, err := os.Executable()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer r.Close()
+
+	// The last line the child writes to stderr contains the error when it
+	// fails, for example a script error or a file that doesn't exist on this agent.
+	var stderr lastLine
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	cmd.ExtraFiles = []*os.File{w} // Becomes streamFd.
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		w.Close()
+		fail(err)
+		return
+	}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// The commands are passed on to the child as they are.
+	go func() {
+		for {
+			var c agentCommand
+			if err := dec.Decode(&c); err != nil {
+				// Stop the run when the coordinator is gone.
+				cmd.Process.Signal(os.Interrupt)
+				return
+			}
+
+			if err := json.NewEncoder(stdin).Encode(c); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+
+	// The records of the child are passed on as they are.
+	if _, err := io.Copy(conn, r); err != nil {
+		log.Print(err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if line := stderr.String(); line != "" {
+			err = fmt.Errorf("%v: %s", err, line)
+		}
+
+		fail(err)
+	}
+}
+
+// writeTemp writes content to a new temporary file and returns its name.
+func writeTemp(pattern, content string) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
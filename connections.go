@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// The number of connections that were closed by the server.
+var serverClosedN = uint64(0)
+
+// trackedConn counts the connection when it is closed by the server.
+type trackedConn struct {
+	net.Conn
+
+	closed uint32
+}
+
+func trackConn(c net.Conn) net.Conn {
+	return &trackedConn{Conn: c}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	if err != nil && (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) {
+		if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+			atomic.AddUint64(&serverClosedN, 1)
+		}
+	}
+
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	// Reads after we closed the connection don't count as a server close.
+	atomic.StoreUint32(&c.closed, 1)
+
+	return c.Conn.Close()
+}
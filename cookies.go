@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/net/publicsuffix"
+)
+
+// With -cookies every worker has its own cookie jar like a browser would.
+// The cookies module allows scripts to inspect and change the cookies of a
+// worker using its state table.
+
+var (
+	// The clients of the workers which use the jars, nil without -cookies.
+	workerClients []*http.Client
+	workerJars    []*workerJar
+
+	// The worker of each state table.
+	stateWorkers     = make(map[*lua.LTable]int, 0)
+	stateWorkersLock sync.Mutex
+)
+
+// workerJar is a cookie jar that can be cleared.
+type workerJar struct {
+	m   sync.Mutex
+	jar *cookiejar.Jar
+}
+
+func newWorkerJar() *workerJar {
+	j := &workerJar{}
+	j.clear()
+
+	return j
+}
+
+func (j *workerJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.jar.SetCookies(u, cookies)
+}
+
+func (j *workerJar) Cookies(u *url.URL) []*http.Cookie {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	return j.jar.Cookies(u)
+}
+
+func (j *workerJar) clear() {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	if err != nil {
+		// cookiejar.New never returns an error.
+		panic(err)
+	}
+
+	j.m.Lock()
+	j.jar = jar
+	j.m.Unlock()
+}
+
+// setupCookies creates a client with its own cookie jar for every worker.
+func setupCookies(workers int, transport http.RoundTripper) {
+	workerClients = make([]*http.Client, workers)
+	workerJars = make([]*workerJar, workers)
+
+	for i := range workerClients {
+		workerJars[i] = newWorkerJar()
+		workerClients[i] = &http.Client{
+			Jar:       workerJars[i],
+			Transport: transport,
+		}
+	}
+}
+
+// clientFor returns the client to use for the requests of a worker.
+func clientFor(worker int) *http.Client {
+	if workerClients == nil {
+		return client
+	}
+
+	return workerClients[worker]
+}
+
+// registerState remembers the worker of a state table.
+func registerState(state *lua.LTable, worker int) {
+	stateWorkersLock.Lock()
+	defer stateWorkersLock.Unlock()
+
+	stateWorkers[state] = worker
+}
+
+func cookiesLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":   cookiesGet,
+		"set":   cookiesSet,
+		"clear": cookiesClear,
+	})
+
+	L.Push(mod)
+
+	return 1
+}
+
+// checkJar returns the jar of the worker of the state table at argument 1.
+func checkJar(L *lua.LState) *workerJar {
+	state := L.CheckTable(1)
+
+	if workerJars == nil {
+		L.RaiseError("cookies can only be used with -cookies")
+	}
+
+	stateWorkersLock.Lock()
+	worker, ok := stateWorkers[state]
+	stateWorkersLock.Unlock()
+
+	if !ok {
+		L.ArgError(1, "state of a worker expected")
+	}
+
+	return workerJars[worker]
+}
+
+func checkURL(L *lua.LState, n int) *url.URL {
+	u, err := url.Parse(L.CheckString(n))
+	if err != nil || !u.IsAbs() {
+		L.ArgError(n, "absolute url expected")
+	}
+
+	return u
+}
+
+// cookiesGet returns a table with the cookies the worker sends to url.
+func cookiesGet(L *lua.LState) int {
+	jar := checkJar(L)
+	u := checkURL(L, 2)
+
+	table := L.NewTable()
+
+	for _, c := range jar.Cookies(u) {
+		table.RawSetString(c.Name, lua.LString(c.Value))
+	}
+
+	L.Push(table)
+
+	return 1
+}
+
+// cookiesSet sets a cookie for url like a Set-Cookie header would.
+func cookiesSet(L *lua.LState) int {
+	jar := checkJar(L)
+	u := checkURL(L, 2)
+	name := L.CheckString(3)
+	value := L.CheckString(4)
+
+	jar.SetCookies(u, []*http.Cookie{{
+		Name:  name,
+		Value: value,
+		Path:  "/",
+	}})
+
+	return 0
+}
+
+// cookiesClear removes all cookies of the worker.
+func cookiesClear(L *lua.LState) int {
+	checkJar(L).clear()
+
+	return 0
+}
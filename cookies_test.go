@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestCookies(t *testing.T) {
+	defer func() {
+		workerClients, workerJars = nil, nil
+	}()
+
+	setupCookies(2, http.DefaultTransport)
+
+	L := lua.NewState()
+	defer L.Close()
+
+	L.PreloadModule("cookies", cookiesLoader)
+
+	states := []*lua.LTable{L.NewTable(), L.NewTable()}
+	for i, state := range states {
+		registerState(state, i)
+		L.SetGlobal("state"+strconv.Itoa(i+1), state)
+	}
+
+	err := L.DoString(`
+		local cookies = require('cookies')
+
+		cookies.set(state1, 'http://example.com/', 'session', 'abc')
+
+		a = cookies.get(state1, 'http://example.com/path')['session']
+		b = cookies.get(state2, 'http://example.com/')['session']
+		c = cookies.get(state1, 'http://example.org/')['session']
+
+		cookies.clear(state1)
+
+		d = cookies.get(state1, 'http://example.com/')['session']
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each worker has its own cookies.
+	expected := map[string]lua.LValue{
+		"a": lua.LString("abc"),
+		"b": lua.LNil,
+		"c": lua.LNil,
+		"d": lua.LNil,
+	}
+
+	for name, value := range expected {
+		if v := L.GetGlobal(name); v != value {
+			t.Fatalf("expected %s to be %v not %v", name, value, v)
+		}
+	}
+
+	// Tables that aren't the state of a worker are an error.
+	if err := L.DoString(`require('cookies').get({}, 'http://example.com/')`); err == nil {
+		t.Fatal("expected a table that isn't a state to be an error")
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erikdubbelboer/hench/internal/histogram"
+	"github.com/erikdubbelboer/hench/internal/threshold"
+)
+
+// Flags that are not passed on to the agents because the coordinator
+// handles them or sets them per agent.
+var coordinatorFlags = map[string]bool{
+	"agents":      true,
+	"agent-token": true,
+	"script":      true,
+	"workers":     true,
+	"requests":    true,
+	"output":      true,
+	"thresholds":  true,
+	"percentiles": true,
+	"stream":      true,
+	"share":       true,
+	"http-ui":     true,
+
+	// Sent as files, see fileFlags.
+	"cert":   true,
+	"key":    true,
+	"cacert": true,
+}
+
+// coordinatorConfig contains the settings of a distributed run.
+type coordinatorConfig struct {
+	agents      []string
+	token       string
+	script      string
+	args        []string
+	workers     int
+	requests    uint64
+	openloop    bool
+	profile     string // The description of the load profile if there is one.
+	thresholds  []threshold.Threshold
+	precision   int
+	percentiles []float64
+	output      string
+	httpUI      string
+}
+
+// agentEvent is a record received from an agent or the end of its stream.
+type agentEvent struct {
+	agent  int
+	record agentRecord
+	done   bool
+	err    error
+}
+
+// pendingSample is a second for which not all agents sent their sample yet.
+type pendingSample struct {
+	sample    sample
+	latencies *histogram.Histogram
+	n         int
+}
+
+// pendingSamples merges the samples the agents send for each second.
+type pendingSamples struct {
+	precision int
+	seconds   map[float64]*pendingSample
+}
+
+func newPendingSamples(precision int) *pendingSamples {
+	return &pendingSamples{
+		precision: precision,
+		seconds:   make(map[float64]*pendingSample, 0),
+	}
+}
+
+// add merges the sample and latencies of an agent into its second.
+func (p *pendingSamples) add(s *sample, latencies *histogram.Counts) error {
+	ps, ok := p.seconds[s.Elapsed]
+	if !ok {
+		ps = &pendingSample{
+			sample: sample{
+				Elapsed:      s.Elapsed,
+				Status:       make(map[string]uint64, 0),
+				ErrorClasses: make(map[string]uint64, 0),
+			},
+			latencies: newLatencyHistogram(p.precision),
+		}
+		p.seconds[s.Elapsed] = ps
+	}
+
+	ps.sample.merge(s)
+	ps.n++
+
+	if latencies != nil {
+		return ps.latencies.AddCounts(*latencies)
+	}
+
+	return nil
+}
+
+// take returns the seconds in order up to the first second for which not
+// all running agents sent their sample, or all seconds when all is true.
+func (p *pendingSamples) take(running int, all bool) []*pendingSample {
+	seconds := make([]float64, 0, len(p.seconds))
+	for elapsed := range p.seconds {
+		seconds = append(seconds, elapsed)
+	}
+	sort.Float64s(seconds)
+
+	done := make([]*pendingSample, 0, len(seconds))
+
+	for _, elapsed := range seconds {
+		ps := p.seconds[elapsed]
+		if ps.n < running && !all {
+			break
+		}
+
+		done = append(done, ps)
+		delete(p.seconds, elapsed)
+	}
+
+	return done
+}
+
+// forwardedFlags returns the flags that were set so they can be passed on
+// to the agents.
+func forwardedFlags() []string {
+	flags := make([]string, 0)
+
+	flag.Visit(func(f *flag.Flag) {
+		if coordinatorFlags[f.Name] {
+			return
+		}
+
+		// -resolve can be repeated.
+		if r, ok := f.Value.(*resolveFlag); ok {
+			for _, s := range *r {
+				flags = append(flags, "-"+f.Name+"="+s)
+			}
+
+			return
+		}
+
+		flags = append(flags, "-"+f.Name+"="+f.Value.String())
+	})
+
+	return flags
+}
+
+// split returns the part of total for agent i of n.
+func split(total uint64, i, n int) uint64 {
+	part := total / uint64(n)
+	if uint64(i) < total%uint64(n) {
+		part++
+	}
+
+	return part
+}
+
+// merge adds the counts of another sample of the same second.
+func (s *sample) merge(o *sample) {
+	s.Warmup = s.Warmup || o.Warmup
+	s.Requests += o.Requests
+	s.Errors += o.Errors
+	s.Late += o.Late
+	s.Dropped += o.Dropped
+	s.NewConns += o.NewConns
+	s.ReusedConns += o.ReusedConns
+	s.ServerClosed += o.ServerClosed
+	s.UploadBytes += o.UploadBytes
+	s.Target += o.Target
+
+	for k, n := range o.Status {
+		s.Status[k] += n
+	}
+	for k, n := range o.ErrorClasses {
+		s.ErrorClasses[k] += n
+	}
+}
+
+// runCoordinator performs a run using agents and reports the merged results.
+func runCoordinator(c coordinatorConfig) {
+	n := len(c.agents)
+
+	if c.token == "" {
+		log.Fatal("the -agent-token of the agents is needed to run on them")
+	}
+
+	if c.workers < n {
+		log.Fatalf("at least one worker per agent is needed for %d agents", n)
+	}
+	if c.requests > 0 && c.requests < uint64(n) {
+		log.Fatalf("at least one request per agent is needed for %d agents", n)
+	}
+
+	source := ""
+	if c.script != "" {
+		b, err := ioutil.ReadFile(c.script)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		source = string(b)
+	}
+
+	files := make(map[string]string, 0)
+	for _, f := range fileFlags {
+		name := flag.Lookup(f).Value.String()
+		if name == "" {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		files[f] = string(b)
+	}
+
+	flags := forwardedFlags()
+	encoders := make([]*json.Encoder, n)
+	decoders := make([]*json.Decoder, n)
+
+	for i, addr := range c.agents {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		encoders[i] = json.NewEncoder(conn)
+		decoders[i] = json.NewDecoder(conn)
+
+		run := agentRun{
+			Token:  c.token,
+			Script: source,
+			Flags: append(flags[:len(flags):len(flags)],
+				"-workers="+strconv.FormatUint(split(uint64(c.workers), i, n), 10),
+				"-requests="+strconv.FormatUint(split(c.requests, i, n), 10),
+				"-share="+strconv.FormatFloat(1/float64(n), 'g', -1, 64),
+			),
+			Args:  c.args,
+			Files: files,
+		}
+
+		if err := encoders[i].Encode(run); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Only start when every agent is ready so they all start together.
+	for i, dec := range decoders {
+		var r agentRecord
+		if err := dec.Decode(&r); err != nil {
+			log.Fatalf("agent %s: %v", c.agents[i], err)
+		}
+		if !r.Ready {
+			log.Fatalf("agent %s: %s", c.agents[i], r.Error)
+		}
+	}
+
+	// Commands can also be sent by the dashboard.
+	var commandLock sync.Mutex
+	command := func(cmd agentCommand) {
+		commandLock.Lock()
+		defer commandLock.Unlock()
+
+		for i, enc := range encoders {
+			if err := enc.Encode(cmd); err != nil {
+				log.Printf("agent %s: %v", c.agents[i], err)
+			}
+		}
+	}
+
+	command(agentCommand{Command: "start"})
+
+	var ui *dashboard
+	if c.httpUI != "" {
+		ui = &dashboard{
+			profile: c.profile != "",
+			setRate: func(rps float64) {
+				command(agentCommand{Command: "rate", Rate: rps})
+			},
+			stop: func() {
+				command(agentCommand{Command: "stop"})
+			},
+		}
+
+		startDashboard(c.httpUI, ui)
+	}
+
+	if c.profile != "" {
+		fmt.Printf("starting %d worker(s) on %d agent(s) with load profile %s\n", c.workers, n, c.profile)
+	} else {
+		fmt.Printf("starting %d worker(s) on %d agent(s)\n", c.workers, n)
+	}
+	fmt.Printf("press Ctrl+C to stop and print statistics\n")
+
+	events := make(chan agentEvent, 0)
+
+	for i, dec := range decoders {
+		go func(i int, dec *json.Decoder) {
+			for {
+				var r agentRecord
+				if err := dec.Decode(&r); err != nil {
+					if err == io.EOF {
+						err = nil
+					}
+
+					events <- agentEvent{agent: i, done: true, err: err}
+					return
+				}
+
+				events <- agentEvent{agent: i, record: r}
+			}
+		}(i, dec)
+	}
+
+	// Wait for Ctrl+C to stop.
+	interrupt := make(chan os.Signal, 0)
+	signal.Notify(interrupt, os.Interrupt)
+
+	st := newStats(c.precision)
+	samples := make([]sample, 0)
+	pending := newPendingSamples(c.precision)
+	running := n
+	reported := 0
+	duration := time.Duration(0)
+	late := uint64(0)
+	dropped := uint64(0)
+	serverClosed := uint64(0)
+
+	// Seconds are printed in order once all agents that are still running
+	// sent their sample for it.
+	flush := func(all bool) {
+		for _, p := range pending.take(running, all) {
+			p.sample.Latency = newLatency(p.latencies, c.percentiles)
+			p.sample.print(c.openloop, c.profile != "")
+			samples = append(samples, p.sample)
+
+			if ui != nil {
+				ui.add(p.sample)
+			}
+		}
+	}
+
+	for running > 0 {
+		select {
+		case <-interrupt:
+			command(agentCommand{Command: "stop"})
+		case e := <-events:
+			agent := c.agents[e.agent]
+
+			if e.done {
+				if e.err != nil {
+					log.Printf("agent %s: %v", agent, e.err)
+				}
+
+				running--
+				flush(false)
+				continue
+			}
+
+			r := e.record
+
+			if r.Error != "" {
+				log.Printf("agent %s: %s", agent, r.Error)
+			}
+
+			if r.Sample != nil {
+				if err := pending.add(r.Sample, r.Latencies); err != nil {
+					log.Fatalf("agent %s: %v", agent, err)
+				}
+
+				flush(false)
+			}
+
+			if r.Stats != nil {
+				if err := st.merge(r.Stats); err != nil {
+					log.Fatalf("agent %s: %v", agent, err)
+				}
+
+				// Agents run at the same time so the run took as long as the
+				// longest agent.
+				if d := time.Duration(r.Stats.Duration * float64(time.Second)); d > duration {
+					duration = d
+				}
+
+				late += r.Stats.Late
+				dropped += r.Stats.Dropped
+				serverClosed += r.Stats.ServerClosed
+				reported++
+			}
+		}
+	}
+
+	flush(true)
+
+	if ui != nil {
+		ui.finish()
+	}
+
+	if reported < n {
+		log.Printf("only %d of %d agent(s) reported their statistics", reported, n)
+	}
+
+	sum := newSummary(st, duration, c.openloop, late, dropped, serverClosed, c.percentiles)
+	sum.Samples = samples
+
+	finish(&sum, st, c.thresholds, c.output)
+}
+
+// parseAgents parses a comma separated list of agent addresses.
+func parseAgents(list string) []string {
+	agents := make([]string, 0)
+
+	for _, agent := range strings.Split(list, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			agents = append(agents, agent)
+		}
+	}
+
+	return agents
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		total    uint64
+		n        int
+		expected []uint64
+	}{
+		{10, 1, []uint64{10}},
+		{10, 2, []uint64{5, 5}},
+		{10, 3, []uint64{4, 3, 3}},
+		{2, 3, []uint64{1, 1, 0}},
+		{0, 2, []uint64{0, 0}},
+	}
+
+	for _, test := range tests {
+		sum := uint64(0)
+
+		for i, expected := range test.expected {
+			part := split(test.total, i, test.n)
+			if part != expected {
+				t.Fatalf("%d over %d: expected part %d to be %d not %d", test.total, test.n, i, expected, part)
+			}
+
+			sum += part
+		}
+
+		if sum != test.total {
+			t.Fatalf("%d over %d: parts add up to %d", test.total, test.n, sum)
+		}
+	}
+}
+
+func TestPendingSamples(t *testing.T) {
+	p := newPendingSamples(3)
+
+	add := func(elapsed float64, requests uint64, latency time.Duration) {
+		h := newLatencyHistogram(3)
+		h.Record(int64(latency))
+		c := h.Counts()
+
+		s := &sample{
+			Elapsed:      elapsed,
+			Requests:     requests,
+			Errors:       1,
+			Status:       map[string]uint64{"200": requests},
+			ErrorClasses: map[string]uint64{"timeout": 1},
+			Target:       50,
+		}
+
+		if err := p.add(s, &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Seconds are only taken when both agents sent their sample, in order.
+	add(2, 10, time.Millisecond)
+	add(1, 20, time.Millisecond)
+
+	if done := p.take(2, false); len(done) != 0 {
+		t.Fatalf("expected no samples not %d", len(done))
+	}
+
+	add(1, 30, 3*time.Millisecond)
+	add(3, 40, time.Millisecond)
+
+	done := p.take(2, false)
+	if len(done) != 1 {
+		t.Fatalf("expected 1 sample not %d", len(done))
+	}
+
+	s := done[0]
+	if s.sample.Elapsed != 1 || s.sample.Requests != 50 || s.sample.Errors != 2 || s.sample.Target != 100 {
+		t.Fatalf("unexpected sample %+v", s.sample)
+	}
+	if s.sample.Status["200"] != 50 || s.sample.ErrorClasses["timeout"] != 2 {
+		t.Fatalf("unexpected counts %v %v", s.sample.Status, s.sample.ErrorClasses)
+	}
+	if s.latencies.Count() != 2 || s.latencies.Max() < int64(3*time.Millisecond) {
+		t.Fatalf("expected the latencies of both agents not %d up to %d", s.latencies.Count(), s.latencies.Max())
+	}
+
+	// When an agent stopped the seconds of the other agent can be taken.
+	if done := p.take(1, false); len(done) != 2 || done[0].sample.Elapsed != 2 || done[1].sample.Elapsed != 3 {
+		t.Fatalf("expected seconds 2 and 3 not %d samples", len(done))
+	}
+
+	add(4, 10, time.Millisecond)
+
+	if done := p.take(2, true); len(done) != 1 {
+		t.Fatalf("expected all samples to be taken not %d", len(done))
+	}
+	if len(p.seconds) != 0 {
+		t.Fatalf("expected no pending seconds not %d", len(p.seconds))
+	}
+}
+
+func TestStatsMerge(t *testing.T) {
+	coordinator := newStats(3)
+
+	for i := 0; i < 2; i++ {
+		agent := newStats(3)
+		agent.record(result{response: true, status: 200, proto: "HTTP/1.1", latency: time.Millisecond, tag: "a", remoteAddr: "127.0.0.1:80", gotConn: true})
+		agent.record(result{failed: true, errorClass: "refused", tag: "b", gotConn: false})
+
+		// The statistics are sent as JSON.
+		b, err := json.Marshal(newAgentStats(agent))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var a agentStats
+		if err := json.Unmarshal(b, &a); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := coordinator.merge(&a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if coordinator.total != 4 || coordinator.requests != 2 || coordinator.errors != 2 || coordinator.newConns != 2 {
+		t.Fatalf("unexpected counters %+v", coordinator.counters)
+	}
+	if coordinator.status[200] != 2 || coordinator.errorClasses["refused"] != 2 || coordinator.protos["HTTP/1.1"] != 2 {
+		t.Fatalf("unexpected counts %v %v %v", coordinator.status, coordinator.errorClasses, coordinator.protos)
+	}
+	if coordinator.latencies.Count() != 2 {
+		t.Fatalf("expected 2 latencies not %d", coordinator.latencies.Count())
+	}
+	if a := coordinator.tags["a"]; a == nil || a.requests != 2 || a.latencies.Count() != 2 {
+		t.Fatalf("unexpected statistics for tag a %+v", a)
+	}
+	if b := coordinator.tags["b"]; b == nil || b.errors != 2 {
+		t.Fatalf("unexpected statistics for tag b %+v", b)
+	}
+	if r := coordinator.remotes["127.0.0.1"]; r == nil || r.requests != 2 {
+		t.Fatalf("unexpected statistics for 127.0.0.1 %+v", r)
+	}
+}
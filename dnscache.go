@@ -1,79 +1,390 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The strategies to pick an address when a host has multiple addresses.
+const (
+	dnsFirst      = "first"
+	dnsRoundRobin = "roundrobin"
+	dnsRandom     = "random"
+	dnsSticky     = "sticky" // Each worker always uses the same address.
 )
 
 var (
-	dnsCache     = make(map[string]string, 0)
+	dnsCacheEnabled = true
+	dnsStrategy     = dnsFirst
+	dnsPrefer       = "" // ipv4, ipv6 or empty to use both.
+
+	// The TTL used when the TTL of a lookup is unknown, for example for hosts
+	// in /etc/hosts.
+	dnsTTL = time.Minute
+
+	// Lookups are cached for at least this long so a TTL of 0 doesn't cause
+	// a lookup for every dial.
+	dnsMinTTL = time.Second
+
+	dnsCache     = make(map[string]*dnsHost, 0)
 	dnsCacheLock sync.RWMutex
+
+	// The addresses passed using -resolve by host:port.
+	dnsOverrides = make(map[string]*dnsHost, 0)
 )
 
-func resolveDomain(domain string) (string, error) {
-	var host string
-	var port string
-	var ip string
-	var ok bool
-	var err error
+// The Go resolver is used so the TTLs can be read from the DNS responses.
+var resolver = &net.Resolver{
+	PreferGo: true,
+	Dial:     ttlDial,
+}
 
-	if strings.Contains(domain, ":") {
-		host, port, err = net.SplitHostPort(domain)
-		if err != nil {
-			return "", err
+var dialer net.Dialer
+
+// dnsHost contains the addresses of a host.
+type dnsHost struct {
+	// Held while looking up the host so only one lookup is done at a time.
+	lookup sync.Mutex
+
+	next uint64 // For round-robin.
+
+	// Protected by dnsCacheLock.
+	ips     []net.IP
+	expires time.Time // Zero for addresses that don't expire.
+}
+
+func (h *dnsHost) expired(now time.Time) bool {
+	return !h.expires.IsZero() && !now.Before(h.expires)
+}
+
+// pick returns one of the addresses using the strategy.
+func (h *dnsHost) pick(ips []net.IP, worker int) net.IP {
+	switch dnsStrategy {
+	case dnsRoundRobin:
+		return ips[(atomic.AddUint64(&h.next, 1)-1)%uint64(len(ips))]
+	case dnsRandom:
+		return ips[rand.Intn(len(ips))]
+	case dnsSticky:
+		return ips[worker%len(ips)]
+	default:
+		return ips[0]
+	}
+}
+
+// preferred returns only the addresses of the preferred IP version, or all
+// addresses when there are none of the preferred version.
+func preferred(ips []net.IP) []net.IP {
+	if dnsPrefer == "" {
+		return ips
+	}
+
+	p := make([]net.IP, 0, len(ips))
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (dnsPrefer == "ipv4") {
+			p = append(p, ip)
 		}
-	} else {
-		host = domain
 	}
 
-	if isIp := net.ParseIP(host); isIp != nil {
-		return domain, nil
+	if len(p) == 0 {
+		return ips
+	}
+
+	return p
+}
+
+// lookup returns all addresses of host and how long they can be cached.
+func lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ttl := &ttlRecorder{}
+
+	// Passing the context makes sure the lookup is traced.
+	addrs, err := resolver.LookupIPAddr(context.WithValue(ctx, ttlKey{}, ttl), host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("failed to lookup %s", host)
 	}
 
-	dnsCacheLock.RLock()
-	{
-		ip, ok = dnsCache[host]
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
 	}
-	dnsCacheLock.RUnlock()
 
+	return ips, ttl.get(), nil
+}
+
+// lookupHost returns the cached addresses of host, looking them up again
+// when they are expired.
+func lookupHost(ctx context.Context, host string) (*dnsHost, []net.IP, error) {
+	dnsCacheLock.Lock()
+	h, ok := dnsCache[host]
 	if !ok {
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			return "", err
-		}
+		h = &dnsHost{}
+		dnsCache[host] = h
+	}
+	ips, expired := h.ips, h.expired(time.Now())
+	dnsCacheLock.Unlock()
+
+	if ips != nil && !expired && dnsCacheEnabled {
+		return h, ips, nil
+	}
+
+	// Without caching every dial does its own lookup.
+	if dnsCacheEnabled {
+		h.lookup.Lock()
+		defer h.lookup.Unlock()
 
-		if len(ips) == 0 {
-			return "", fmt.Errorf("failed to lookup %s", host)
+		// Another worker might have done the lookup while we were waiting.
+		dnsCacheLock.RLock()
+		ips, expired = h.ips, h.expired(time.Now())
+		dnsCacheLock.RUnlock()
+
+		if ips != nil && !expired {
+			return h, ips, nil
 		}
+	}
+
+	ips, ttl, err := lookup(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ips = preferred(ips)
+
+	dnsCacheLock.Lock()
+	h.ips = ips
+	h.expires = time.Now().Add(ttl)
+	dnsCacheLock.Unlock()
+
+	return h, ips, nil
+}
+
+// resolveAddr resolves the host of addr, a host:port, to one of its addresses.
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
 
-		// If it's an ipv6 address we need brackets around it.
-		if ipv4 := ips[0].To4(); ipv4 != nil {
-			ip = ipv4.String()
-		} else {
-			ip = "[" + ips[0].String() + "]"
+	if ip := net.ParseIP(host); ip != nil {
+		return addr, nil
+	}
+
+	worker := workerFromContext(ctx)
+
+	if h, ok := dnsOverrides[addr]; ok {
+		return net.JoinHostPort(h.pick(h.ips, worker).String(), port), nil
+	}
+
+	h, ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(h.pick(ips, worker).String(), port), nil
+}
+
+// ownResolve returns true when hosts have to be resolved by us instead of
+// the dialer, which uses the system resolver and tries all addresses.
+func ownResolve(addr string) bool {
+	if dnsCacheEnabled || dnsStrategy != dnsFirst || dnsPrefer != "" {
+		return true
+	}
+
+	_, ok := dnsOverrides[addr]
+	return ok
+}
+
+func resolveDial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if ownResolve(addr) {
+		var err error
+		if addr, err = resolveAddr(ctx, addr); err != nil {
+			return nil, err
 		}
+	}
 
-		dnsCacheLock.Lock()
-		{
-			dnsCache[host] = ip
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return trackConn(conn), nil
+}
+
+// addOverride adds an override like curl's --resolve formatted as
+// host:port:address[,address]...
+func addOverride(s string) error {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid resolve: %s", s)
+	}
+
+	ips := make([]net.IP, 0)
+
+	for _, addr := range strings.Split(parts[2], ",") {
+		ip := net.ParseIP(strings.Trim(strings.TrimSpace(addr), "[]"))
+		if ip == nil {
+			return fmt.Errorf("invalid address in resolve: %s", s)
 		}
-		dnsCacheLock.Unlock()
+
+		ips = append(ips, ip)
 	}
 
-	if port != "" {
-		return ip + ":" + port, nil
-	} else {
-		return ip, nil
+	dnsOverrides[net.JoinHostPort(parts[0], parts[1])] = &dnsHost{
+		ips: preferred(ips),
 	}
+
+	return nil
+}
+
+// resolveFlag collects the -resolve flags.
+type resolveFlag []string
+
+func (r *resolveFlag) String() string {
+	return strings.Join(*r, " ")
 }
 
-func cacheDial(network string, addr string) (net.Conn, error) {
-	url, err := resolveDomain(addr)
+func (r *resolveFlag) Set(s string) error {
+	*r = append(*r, s)
+	return nil
+}
+
+type workerKey struct{}
+
+// withWorker returns a context that carries the worker number so the sticky
+// strategy can pick the address of the worker.
+func withWorker(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, workerKey{}, n)
+}
+
+func workerFromContext(ctx context.Context) int {
+	n, _ := ctx.Value(workerKey{}).(int)
+	return n
+}
+
+type ttlKey struct{}
+
+// ttlRecorder records the lowest TTL of the answers to the DNS queries of a
+// lookup.
+type ttlRecorder struct {
+	m   sync.Mutex
+	ttl time.Duration
+	ok  bool
+}
+
+func (r *ttlRecorder) get() time.Duration {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !r.ok {
+		return dnsTTL
+	}
+
+	if r.ttl < dnsMinTTL {
+		return dnsMinTTL
+	}
+
+	return r.ttl
+}
+
+func (r *ttlRecorder) parse(msg []byte) {
+	var p dnsmessage.Parser
+
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+
+		if ttl := time.Duration(h.TTL) * time.Second; !r.ok || ttl < r.ttl {
+			r.ttl = ttl
+			r.ok = true
+		}
+
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttlDial dials the DNS servers for the resolver. The responses are read
+// by the connection so the TTLs can be recorded.
+func ttlDial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
 
-	return net.Dial(network, url)
+	r, ok := ctx.Value(ttlKey{}).(*ttlRecorder)
+	if !ok {
+		return conn, nil
+	}
+
+	// The resolver uses a different format for packet connections so the
+	// connection has to stay a net.PacketConn.
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &ttlPacketConn{UDPConn: udp, r: r}, nil
+	}
+
+	return &ttlStreamConn{Conn: conn, r: r}, nil
+}
+
+// ttlPacketConn receives one DNS message per read.
+type ttlPacketConn struct {
+	*net.UDPConn
+	r *ttlRecorder
+}
+
+func (c *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.r.parse(b[:n])
+	}
+
+	return n, err
+}
+
+// ttlStreamConn receives DNS messages prefixed with their length.
+type ttlStreamConn struct {
+	net.Conn
+	r   *ttlRecorder
+	buf []byte
+}
+
+func (c *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.buf = append(c.buf, b[:n]...)
+
+	for len(c.buf) >= 2 {
+		l := int(c.buf[0])<<8 | int(c.buf[1])
+		if len(c.buf) < 2+l {
+			break
+		}
+
+		c.r.parse(c.buf[2 : 2+l])
+		c.buf = c.buf[2+l:]
+	}
+
+	return n, err
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsResponse returns a DNS response with an A record per TTL.
+func dnsResponse(t *testing.T, ttls ...uint32) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.EnableCompression()
+
+	name := dnsmessage.MustNewName("example.com.")
+
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ttl := range ttls {
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if err := b.AResource(h, dnsmessage.AResource{A: [4]byte{127, 0, 0, byte(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestTTLRecorder(t *testing.T) {
+	tests := []struct {
+		responses [][]uint32
+		expected  time.Duration
+	}{
+		{nil, dnsTTL},
+		{[][]uint32{{}}, dnsTTL},
+		{[][]uint32{{300}}, 300 * time.Second},
+		{[][]uint32{{300, 60, 120}}, time.Minute},
+		{[][]uint32{{300}, {30}}, 30 * time.Second},
+		{[][]uint32{{0}}, dnsMinTTL},
+	}
+
+	for _, test := range tests {
+		r := &ttlRecorder{}
+
+		for _, ttls := range test.responses {
+			r.parse(dnsResponse(t, ttls...))
+		}
+
+		if ttl := r.get(); ttl != test.expected {
+			t.Fatalf("%v: expected %v not %v", test.responses, test.expected, ttl)
+		}
+	}
+
+	// Invalid responses are ignored.
+	r := &ttlRecorder{}
+	r.parse([]byte{1, 2, 3})
+
+	if ttl := r.get(); ttl != dnsTTL {
+		t.Fatalf("expected %v not %v", dnsTTL, ttl)
+	}
+}
+
+func TestTTLStreamConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	msg := dnsResponse(t, 42)
+	framed := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+
+	go func() {
+		// Split the message over multiple writes like TCP can.
+		server.Write(framed[:1])
+		server.Write(framed[1:10])
+		server.Write(framed[10:])
+		server.Close()
+	}()
+
+	r := &ttlRecorder{}
+	c := &ttlStreamConn{Conn: client, r: r}
+
+	buf := make([]byte, 4)
+	for {
+		if _, err := c.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if ttl := r.get(); ttl != 42*time.Second {
+		t.Fatalf("expected %v not %v", 42*time.Second, ttl)
+	}
+}
+
+func TestPick(t *testing.T) {
+	defer func(strategy string) {
+		dnsStrategy = strategy
+	}(dnsStrategy)
+
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+
+	tests := []struct {
+		strategy string
+		workers  []int
+		expected []string
+	}{
+		{dnsFirst, []int{0, 1, 2, 3}, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.1"}},
+		{dnsRoundRobin, []int{0, 0, 0, 0}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}},
+		{dnsSticky, []int{0, 1, 2, 3, 1}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2"}},
+	}
+
+	for _, test := range tests {
+		dnsStrategy = test.strategy
+		h := &dnsHost{}
+
+		for i, worker := range test.workers {
+			if ip := h.pick(ips, worker).String(); ip != test.expected[i] {
+				t.Fatalf("%s: expected pick %d to be %s not %s", test.strategy, i, test.expected[i], ip)
+			}
+		}
+	}
+
+	dnsStrategy = dnsRandom
+	h := &dnsHost{}
+
+	for i := 0; i < 10; i++ {
+		if ip := h.pick(ips, 0); !ip.Equal(ips[0]) && !ip.Equal(ips[1]) && !ip.Equal(ips[2]) {
+			t.Fatalf("random: unexpected address %s", ip)
+		}
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	defer func(prefer string) {
+		dnsPrefer = prefer
+	}(dnsPrefer)
+
+	both := []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1"), net.ParseIP("::2")}
+	v6 := []net.IP{net.ParseIP("::1")}
+
+	tests := []struct {
+		prefer   string
+		ips      []net.IP
+		expected string
+	}{
+		{"", both, "[::1 127.0.0.1 ::2]"},
+		{"ipv4", both, "[127.0.0.1]"},
+		{"ipv6", both, "[::1 ::2]"},
+		{"ipv4", v6, "[::1]"},
+	}
+
+	for _, test := range tests {
+		dnsPrefer = test.prefer
+
+		if ips := fmt.Sprint(preferred(test.ips)); ips != test.expected {
+			t.Fatalf("%q %v: expected %s not %s", test.prefer, test.ips, test.expected, ips)
+		}
+	}
+}
+
+func TestAddOverride(t *testing.T) {
+	defer func(overrides map[string]*dnsHost) {
+		dnsOverrides = overrides
+	}(dnsOverrides)
+
+	dnsOverrides = make(map[string]*dnsHost, 0)
+
+	if err := addOverride("example.com:443:127.0.0.1, [::1]"); err != nil {
+		t.Fatal(err)
+	}
+
+	h, ok := dnsOverrides["example.com:443"]
+	if !ok {
+		t.Fatal("expected an override for example.com:443")
+	}
+	if ips := fmt.Sprint(h.ips); ips != "[127.0.0.1 ::1]" {
+		t.Fatalf("expected [127.0.0.1 ::1] not %s", ips)
+	}
+
+	for _, invalid := range []string{"example.com:443", ":443:127.0.0.1", "example.com::127.0.0.1", "example.com:443:localhost"} {
+		if err := addOverride(invalid); err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+
+	// Overrides are used for their host and port only.
+	addr, err := resolveAddr(withWorker(context.Background(), 1), "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "127.0.0.1:443" {
+		t.Fatalf("expected 127.0.0.1:443 not %s", addr)
+	}
+
+	// Even when the dialer could resolve other hosts.
+	defer func(enabled bool) {
+		dnsCacheEnabled = enabled
+	}(dnsCacheEnabled)
+
+	dnsCacheEnabled = false
+
+	if !ownResolve("example.com:443") {
+		t.Fatal("expected example.com:443 to be resolved using the override")
+	}
+	if ownResolve("example.com:80") {
+		t.Fatal("expected example.com:80 to be resolved by the dialer")
+	}
+}
+
+func TestOwnResolve(t *testing.T) {
+	defer func(enabled bool, strategy, prefer string) {
+		dnsCacheEnabled, dnsStrategy, dnsPrefer = enabled, strategy, prefer
+	}(dnsCacheEnabled, dnsStrategy, dnsPrefer)
+
+	tests := []struct {
+		enabled  bool
+		strategy string
+		prefer   string
+		expected bool
+	}{
+		{true, dnsFirst, "", true},
+		{false, dnsFirst, "", false},
+		{false, dnsRoundRobin, "", true},
+		{false, dnsFirst, "ipv6", true},
+	}
+
+	for _, test := range tests {
+		dnsCacheEnabled, dnsStrategy, dnsPrefer = test.enabled, test.strategy, test.prefer
+
+		if own := ownResolve("example.com:80"); own != test.expected {
+			t.Fatalf("%+v: expected %t not %t", test, test.expected, own)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The classes of errors that are counted separately.
+const (
+	errorDNS      = "dns"
+	errorRefused  = "refused"
+	errorTimeout  = "timeout"
+	errorTLS      = "tls"
+	errorReset    = "reset"
+	errorOther    = "other"
+	errorRejected = "rejected" // The response function didn't return true.
+)
+
+// classifyError returns the class of a transport error.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var quicErr *quic.TransportError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return errorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorRefused
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errorTimeout
+	case errors.As(err, &recordErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr),
+		errors.As(err, &quicErr) && quicErr.ErrorCode.IsCryptoError():
+		return errorTLS
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return errorReset
+	}
+
+	return errorOther
+}
@@ -1,11 +1,54 @@
 
 --[[
-  The script itself is only executed once.
+  The script itself is executed once for each Lua state (see -states).
 
-  You can use global variables which will be shared between all requests.
+  With the default of one state you can use global variables which will be
+  shared between all requests. With multiple states each state has its own
+  globals. Values that should be shared between all states can be stored
+  using the shared module which supports nil, boolean, number and string
+  values:
+    shared.get(key)        returns the value stored under key.
+    shared.set(key, value) stores value under key.
+    shared.add(key, n)     atomically adds n (default 1) to the number stored
+                           under key and returns the new number.
 ]]--
 
-local counter = 0
+local shared = require('shared')
+
+--[[
+  The feeder module reads rows from CSV and JSON lines files. A feeder is
+  shared between all workers and states:
+    feeder.open(file, options) opens the file, options is a strategy or a
+                               table with these fields:
+      strategy  sequential (default) returns every row once in file order.
+                circular returns the rows in file order and starts over at
+                the end. random returns random rows. unique returns every
+                row once in a random order.
+      format    csv or jsonl, defaults to jsonl for .jsonl, .ndjson and .json
+                files and csv for other files. jsonl files contain a JSON
+                value per line or an array with a value per row.
+      delimiter the CSV delimiter, defaults to a tab for .tsv files and a
+                comma for other files.
+      header    false when the first CSV row isn't a header (default true).
+      stop      false to not stop the run when the feeder is exhausted
+                (default true). Requests that are in flight are finished
+                before the run stops.
+    f:next()                   returns the next row or nil when the feeder is
+                               exhausted. CSV rows with a header are tables
+                               with the columns as keys.
+
+  local users = feeder.open('users.csv', 'unique')
+]]--
+
+--[[
+  With -cookies every worker has its own cookie jar. Cookies set by responses
+  are sent with the next requests of the same worker. The cookies module
+  changes the jar of the worker of a state table:
+    cookies.get(state, url)              returns a table with the names and
+                                         values of the cookies sent to url.
+    cookies.set(state, url, name, value) sets a cookie for url.
+    cookies.clear(state)                 removes all cookies of the worker.
+]]--
 
 --[[
   The request function is called each time a request is constructed.
@@ -16,13 +59,33 @@ local counter = 0
 
   Return value:
     An object containing the request that should be performed.
+    Statistics are also reported per tag. The tag can be set using the name
+    or tag field and defaults to the method and path of the url with
+    numeric and id like path segments replaced by :id (e.g. GET /users/:id).
+    The timeout field overrides -timeout for the request and can be a number
+    of seconds or a duration string like '500ms'.
+
+    The body field is a string or a function that is called for each chunk
+    of a chunked body and returns nil at the end. Large bodies don't have to
+    be kept in memory, body_file streams a file and multipart is a list of
+    form fields and files that is written while the request is sent:
+      ['body_file'] = 'upload.bin',
+      ['multipart'] = {
+        { ['name'] = 'title', ['value'] = 'hello' },
+        { ['name'] = 'upload', ['file'] = 'upload.bin',
+          ['filename'] = 'a.bin', ['content_type'] = 'application/octet-stream' },
+      },
+    The filename defaults to the name of the file and the content_type to
+    application/octet-stream. Only one of body, body_file and multipart can
+    be used. The bytes uploaded are reported separately.
 ]]--
 function request(state)
-  counter = counter + 1
+  local counter = shared.add('counter')
 
   return {
     ['method' ] = 'GET',
     ['url'    ] = 'http://127.0.0.1:9090/',
+    ['name'   ] = 'index',
     ['headers'] = {
       ['User-Agent'] = 'hench example',
       ['X-Foo']      = counter
@@ -38,6 +101,7 @@ end
        For example:
          {
            ['status']  = 200,
+           ['proto']   = 'HTTP/1.1',
            ['body']    = 'test',
            ['headers'] = {
              ['X-Foo'] = {
@@ -45,8 +109,20 @@ end
                'baz'
              },
              ['Connection'] = 'keep-alive'
-           }
+           },
+           ['timings'] = {
+             ['dns']     = 0,     -- DNS lookup (0 when cached or reused).
+             ['connect'] = 0.12,  -- TCP connect (0 when reused).
+             ['tls']     = 0,     -- TLS handshake (0 when reused or http).
+             ['quic']    = 0,     -- QUIC handshake (only for new HTTP/3 connections).
+             ['upload']  = 0,     -- Sending the request body (0 without a body).
+             ['ttfb']    = 1.53,  -- Time to first byte since the start.
+             ['body']    = 0.02   -- Time reading the body.
+           },
+           ['zero_rtt']    = false,            -- A new HTTP/3 connection used 0-RTT.
+           ['remote_addr'] = '127.0.0.1:80'    -- The address of the server.
          }
+       All timings are in milliseconds.
     1: A per worker state table that can be used to keep a state between the
 		   request and response function.
 
@@ -58,3 +134,105 @@ function response(res, state)
   return res.status == 200
 end
 
+--[[
+  Instead of the request function a scenario function can be defined for
+  multi-step flows. Each worker runs the scenario over and over again as a
+  coroutine. Requests are performed with http.send which waits for the rate
+  limiter and returns the response table passed to the response function, or
+  nil and the class of the error when the request failed. Each request is
+  timed and recorded like requests returned by the request function.
+  As do is a Lua keyword http.do(req) can't be used but http['do'](req)
+  is the same as http.send(req).
+
+  The response function is called for each response to decide if it was a
+  success. Without a response function responses below 400 are successful.
+
+  sleep(seconds) pauses the scenario to simulate think time. The number of
+  seconds can also be a duration string like '500ms'. A scenario can't yield
+  in any other way. When it returns without sending a request the worker
+  still waits for the rate limiter before running it again.
+
+    local http = require('http')
+
+    function scenario(state)
+      local res, err = http.send({
+        ['method'] = 'POST',
+        ['url']    = 'http://127.0.0.1:9090/login',
+        ['name']   = 'login',
+      })
+      if res == nil or res.status ~= 200 then
+        return
+      end
+
+      sleep('2s')
+
+      http.send({ ['url'] = 'http://127.0.0.1:9090/cart', ['name'] = 'cart' })
+    end
+]]--
+
+
+--[[
+  Optionally a load profile can be defined to change the rate over time.
+  The profile starts at the rate passed with -rps and the run stops when all
+  stages are done. A -profile flag takes precedence over this global.
+
+  The profile can be a string in the same format as -profile, a table of
+  stages or a function:
+    profile = 'ramp:500:60s,hold:5m,spike:2000:10s'
+
+    profile = {
+      { ['stage'] = 'ramp',  ['rps'] = 500,  ['duration'] = '60s' },
+      { ['stage'] = 'hold',                  ['duration'] = '5m'  },
+      { ['stage'] = 'spike', ['rps'] = 2000, ['duration'] = 10    },
+    }
+
+  Stages:
+    ramp:  linearly change the rate to rps.
+    hold:  keep the current rate.
+    step:  change the rate to rps.
+    spike: change the rate to rps and return to the previous rate after.
+
+  A profile function is called every 100 milliseconds with the number of
+  seconds since the start and should return the target rate. Returning nil
+  stops the run.
+    function profile(elapsed)
+      return math.min(elapsed * 10, 500)
+    end
+]]--
+
+--[[
+  Optionally thresholds can be defined that are checked against the final
+  statistics. When any of them is breached hench exits with exit code 3.
+  A -thresholds flag takes precedence over this global.
+
+  Metrics:
+    p<percentile>, min, mean, max: latencies like 200ms or 1.5s.
+    error_rate:                    a percentage like 1% or a fraction like 0.01.
+    rps, requests, errors, late, dropped: numbers.
+
+  Operators: <, <=, >, >=, ==
+
+  Latency thresholds fail when no responses were received.
+    thresholds = {
+      'p99<1s',
+      'error_rate<1%',
+    }
+]]--
+
+--[[
+  Optionally the TLS settings can be defined. Flags like -cert and -insecure
+  take precedence over the fields of this global.
+    tls = {
+      ['cert']        = 'client.pem', -- Client certificate.
+      ['key']         = 'client.key', -- Client key, defaults to cert.
+      ['ca']          = 'ca.pem',     -- CA bundle instead of the system CAs.
+      ['insecure']    = false,        -- Don't verify server certificates.
+      ['server_name'] = 'example.com', -- Override the SNI server name.
+      ['min_version'] = '1.2',        -- 1.0, 1.1, 1.2 or 1.3.
+      ['max_version'] = '1.3',
+      ['ciphers']     = {             -- TLS 1.0-1.2 cipher suites.
+        'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256',
+      },
+      ['resumption']  = true,         -- Resume sessions on new connections.
+    }
+]]--
@@ -1,4 +1,7 @@
 
+-- This stops after 30 responses, for simple cases like this
+-- the -requests flag can be used instead.
+
 local counter = 0
 
 function request(state)
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// The feeder module reads rows from CSV and JSON lines files for the
+// requests. Feeders are shared between all workers and Lua states, opening
+// the same file with the same options in multiple states returns the same
+// feeder.
+
+// The order in which a feeder returns its rows.
+const (
+	feederSequential = "sequential" // In file order, every row once.
+	feederCircular   = "circular"   // In file order, starting over at the end.
+	feederRandom     = "random"     // Random rows, rows can be returned multiple times.
+	feederUnique     = "unique"     // In random order, every row once.
+)
+
+var (
+	feeders     = make(map[string]*feeder, 0)
+	feedersLock sync.Mutex
+)
+
+// feeder returns the rows of a file. Rows are []string for CSV files and the
+// decoded JSON for JSON files. JSON files contain a value per line or an
+// array with a value per row.
+type feeder struct {
+	m sync.Mutex
+
+	name      string
+	strategy  string
+	jsonl     bool
+	delimiter rune
+	header    bool
+
+	// When the feeder is exhausted the run finishes.
+	stop bool
+
+	// Sequential and circular feeders read the rows from the file when they
+	// are needed, the other strategies read all rows at once.
+	file    *os.File
+	csv     *csv.Reader
+	lines   *bufio.Reader
+	array   *json.Decoder // For JSON files with an array.
+	columns []string
+
+	rows      []interface{}
+	next      int
+	exhausted bool
+}
+
+func feederLoader(L *lua.LState) int {
+	mt := L.NewTypeMetatable("feeder")
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"next": feederNext,
+	}))
+
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"open": feederOpen,
+	})
+
+	L.Push(mod)
+
+	return 1
+}
+
+// feederOpen opens a feeder. The options are a strategy or a table with the
+// strategy, format (csv or jsonl), delimiter, header and stop options.
+func feederOpen(L *lua.LState) int {
+	name := L.CheckString(1)
+
+	f := &feeder{
+		name:      name,
+		strategy:  feederSequential,
+		delimiter: ',',
+		header:    true,
+		stop:      true,
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jsonl", ".ndjson", ".json":
+		f.jsonl = true
+	case ".tsv":
+		f.delimiter = '\t'
+	}
+
+	switch options := L.Get(2).(type) {
+	case lua.LString:
+		f.strategy = string(options)
+	case *lua.LTable:
+		if strategy, ok := options.RawGetString("strategy").(lua.LString); ok {
+			f.strategy = string(strategy)
+		}
+
+		if format, ok := options.RawGetString("format").(lua.LString); ok {
+			switch format {
+			case "csv":
+				f.jsonl = false
+			case "jsonl":
+				f.jsonl = true
+			default:
+				L.ArgError(2, "unknown format: "+string(format))
+			}
+		}
+
+		if delimiter, ok := options.RawGetString("delimiter").(lua.LString); ok {
+			r := []rune(string(delimiter))
+			if len(r) != 1 {
+				L.ArgError(2, "the delimiter should be one character")
+			}
+
+			f.delimiter = r[0]
+		}
+
+		if header, ok := options.RawGetString("header").(lua.LBool); ok {
+			f.header = bool(header)
+		}
+		if stop, ok := options.RawGetString("stop").(lua.LBool); ok {
+			f.stop = bool(stop)
+		}
+	case *lua.LNilType:
+	default:
+		L.ArgError(2, "options should be a strategy or a table")
+	}
+
+	switch f.strategy {
+	case feederSequential, feederCircular, feederRandom, feederUnique:
+	default:
+		L.ArgError(2, "unknown strategy: "+f.strategy)
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	key := fmt.Sprintf("%s %s %t %q %t %t", abs, f.strategy, f.jsonl, f.delimiter, f.header, f.stop)
+
+	feedersLock.Lock()
+	defer feedersLock.Unlock()
+
+	if existing, ok := feeders[key]; ok {
+		f = existing
+	} else {
+		if err := f.open(); err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		feeders[key] = f
+	}
+
+	ud := L.NewUserData()
+	ud.Value = f
+	L.SetMetatable(ud, L.GetTypeMetatable("feeder"))
+	L.Push(ud)
+
+	return 1
+}
+
+// open opens the file and reads all rows when the strategy needs them.
+func (f *feeder) open() error {
+	if err := f.rewind(); err != nil {
+		return err
+	}
+
+	if f.strategy == feederSequential || f.strategy == feederCircular {
+		return nil
+	}
+
+	defer f.file.Close()
+
+	f.rows = make([]interface{}, 0)
+
+	for {
+		row, err := f.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		f.rows = append(f.rows, row)
+	}
+
+	if len(f.rows) == 0 {
+		return fmt.Errorf("%s has no rows", f.name)
+	}
+
+	if f.strategy == feederUnique {
+		rand.Shuffle(len(f.rows), func(i, j int) {
+			f.rows[i], f.rows[j] = f.rows[j], f.rows[i]
+		})
+	}
+
+	return nil
+}
+
+// rewind (re)opens the file and reads the header.
+func (f *feeder) rewind() error {
+	if f.file != nil {
+		f.file.Close()
+	}
+
+	file, err := os.Open(f.name)
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+
+	if f.jsonl {
+		f.lines = bufio.NewReader(file)
+		f.array = nil
+
+		// Skip whitespace to see if the file is an array.
+		for {
+			b, err := f.lines.ReadByte()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+				continue
+			}
+
+			f.lines.UnreadByte()
+
+			if b == '[' {
+				f.array = json.NewDecoder(f.lines)
+
+				// The opening bracket.
+				if _, err := f.array.Token(); err != nil {
+					return fmt.Errorf("%s: %v", f.name, err)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	f.csv = csv.NewReader(file)
+	f.csv.Comma = f.delimiter
+	f.csv.FieldsPerRecord = -1
+
+	if f.header {
+		if f.columns, err = f.csv.Read(); err == io.EOF {
+			return fmt.Errorf("%s has no header", f.name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// read reads the next row from the file.
+func (f *feeder) read() (interface{}, error) {
+	if !f.jsonl {
+		return f.csv.Read()
+	}
+
+	for f.array != nil {
+		if !f.array.More() {
+			return nil, io.EOF
+		}
+
+		var row interface{}
+		if err := f.array.Decode(&row); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+
+		// nil is used for exhausted feeders.
+		if row != nil {
+			return row, nil
+		}
+	}
+
+	for {
+		line, err := f.lines.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var row interface{}
+		if err := json.Unmarshal(line, &row); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+
+		// nil is used for exhausted feeders.
+		if row == nil {
+			continue
+		}
+
+		return row, nil
+	}
+}
+
+// take returns the next row or nil when the feeder is exhausted.
+func (f *feeder) take() (interface{}, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.exhausted {
+		return nil, nil
+	}
+
+	switch f.strategy {
+	case feederRandom:
+		return f.rows[rand.Intn(len(f.rows))], nil
+	case feederUnique:
+		if f.next < len(f.rows) {
+			f.next++
+			return f.rows[f.next-1], nil
+		}
+	case feederSequential, feederCircular:
+		row, err := f.read()
+		if err == io.EOF && f.strategy == feederCircular && f.next > 0 {
+			if err := f.rewind(); err != nil {
+				return nil, err
+			}
+
+			row, err = f.read()
+		}
+
+		if err == nil {
+			f.next++
+			return row, nil
+		} else if err != io.EOF {
+			return nil, err
+		}
+
+		f.file.Close()
+	}
+
+	f.exhausted = true
+
+	if f.stop {
+		finishRun()
+	}
+
+	return nil, nil
+}
+
+// toLua converts a row to a Lua value. CSV rows with a header become tables
+// with the columns as keys.
+func (f *feeder) toLua(L *lua.LState, row interface{}) lua.LValue {
+	record, ok := row.([]string)
+	if !ok {
+		return jsonToLua(L, row)
+	}
+
+	table := L.NewTable()
+
+	for i, value := range record {
+		if f.header && i < len(f.columns) {
+			table.RawSetString(f.columns[i], lua.LString(value))
+		} else {
+			table.RawSetInt(i+1, lua.LString(value))
+		}
+	}
+
+	return table
+}
+
+func jsonToLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(jsonToLua(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, jsonToLua(L, item))
+		}
+		return table
+	}
+
+	return lua.LNil
+}
+
+// feederNext returns the next row or nil when the feeder is exhausted.
+func feederNext(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+
+	f, ok := ud.Value.(*feeder)
+	if !ok {
+		L.ArgError(1, "feeder expected")
+	}
+
+	row, err := f.take()
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	if row == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(f.toLua(L, row))
+	}
+
+	return 1
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// openFeeder writes content to a file called name and opens a feeder for it
+// that doesn't finish the run when it's exhausted.
+func openFeeder(t *testing.T, name, content, strategy string) *feeder {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &feeder{
+		name:      path,
+		strategy:  strategy,
+		jsonl:     filepath.Ext(name) == ".jsonl" || filepath.Ext(name) == ".json",
+		delimiter: ',',
+		header:    true,
+	}
+
+	if err := f.open(); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return f
+}
+
+// takeRows takes n rows from f formatted using fmt.Sprint.
+func takeRows(t *testing.T, f *feeder, n int) []string {
+	t.Helper()
+
+	rows := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		row, err := f.take()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows = append(rows, fmt.Sprint(row))
+	}
+
+	return rows
+}
+
+func TestFeederTake(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+		rows    []string
+	}{
+		{"users.csv", "name,id\na,1\nb,2\nc,3\n", []string{"[a 1]", "[b 2]", "[c 3]"}},
+		{"users.jsonl", "{\"id\": 1}\n\n{\"id\": 2}\nnull\n{\"id\": 3}", []string{"map[id:1]", "map[id:2]", "map[id:3]"}},
+		{"users.json", " [{\"id\": 1}, null, {\"id\": 2},\n{\"id\": 3}]", []string{"map[id:1]", "map[id:2]", "map[id:3]"}},
+	}
+
+	for _, file := range files {
+		exhausted := append(file.rows, "<nil>", "<nil>")
+
+		tests := []struct {
+			strategy string
+			expected []string
+		}{
+			{feederSequential, exhausted},
+			{feederCircular, append(file.rows, file.rows...)},
+		}
+
+		for _, test := range tests {
+			f := openFeeder(t, file.name, file.content, test.strategy)
+
+			rows := takeRows(t, f, len(test.expected))
+			if fmt.Sprint(rows) != fmt.Sprint(test.expected) {
+				t.Fatalf("%s %s: expected %v not %v", file.name, test.strategy, test.expected, rows)
+			}
+		}
+
+		// Unique returns every row once in a random order.
+		f := openFeeder(t, file.name, file.content, feederUnique)
+
+		rows := takeRows(t, f, len(exhausted))
+		sort.Strings(rows[:len(file.rows)])
+		if fmt.Sprint(rows) != fmt.Sprint(exhausted) {
+			t.Fatalf("%s unique: expected %v not %v", file.name, exhausted, rows)
+		}
+
+		// Random keeps returning rows of the file.
+		f = openFeeder(t, file.name, file.content, feederRandom)
+
+		for _, row := range takeRows(t, f, 10) {
+			found := false
+			for _, r := range file.rows {
+				found = found || r == row
+			}
+
+			if !found {
+				t.Fatalf("%s random: unexpected row %s", file.name, row)
+			}
+		}
+	}
+}
+
+func TestFeederEmpty(t *testing.T) {
+	// A file with only a header doesn't have rows.
+	f := openFeeder(t, "users.csv", "name,id\n", feederSequential)
+	if rows := takeRows(t, f, 1); rows[0] != "<nil>" {
+		t.Fatalf("expected no rows not %v", rows)
+	}
+
+	f = openFeeder(t, "users.csv", "name,id\n", feederCircular)
+	if rows := takeRows(t, f, 1); rows[0] != "<nil>" {
+		t.Fatalf("expected no rows not %v", rows)
+	}
+
+	for _, strategy := range []string{feederRandom, feederUnique} {
+		path := filepath.Join(t.TempDir(), "users.csv")
+		if err := ioutil.WriteFile(path, []byte("name,id\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		f := &feeder{name: path, strategy: strategy, delimiter: ',', header: true}
+		if err := f.open(); err == nil {
+			t.Fatalf("%s: expected a file without rows to be an error", strategy)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "empty.csv")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f = &feeder{name: path, strategy: feederSequential, delimiter: ',', header: true}
+	if err := f.open(); err == nil {
+		t.Fatal("expected a file without a header to be an error")
+	}
+}
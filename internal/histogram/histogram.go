@@ -0,0 +1,302 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Histogram is a high dynamic range histogram that records values with a
+// fixed number of significant digits using a fixed amount of memory.
+//
+// A Histogram is not safe for concurrent use.
+type Histogram struct {
+	lowest  int64
+	highest int64
+	digits  int
+
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int64
+	subBucketHalfCount          int64
+	subBucketMask               int64
+
+	counts []int64
+	total  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+// New creates a new histogram that can record values between `lowest` and
+// `highest` with `digits` significant digits of precision.
+// Values above `highest` are recorded as `highest`.
+func New(lowest, highest int64, digits int) *Histogram {
+	if lowest < 1 {
+		lowest = 1
+	}
+	if highest < 2*lowest {
+		highest = 2 * lowest
+	}
+	if digits < 1 {
+		digits = 1
+	} else if digits > 5 {
+		digits = 5
+	}
+
+	largestWithSingleUnitResolution := 2 * math.Pow10(digits)
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(largestWithSingleUnitResolution)))
+
+	h := &Histogram{
+		lowest:                      lowest,
+		highest:                     highest,
+		digits:                      digits,
+		unitMagnitude:               uint(math.Floor(math.Log2(float64(lowest)))),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+	}
+
+	h.subBucketCount = 1 << subBucketCountMagnitude
+	h.subBucketHalfCount = h.subBucketCount / 2
+	h.subBucketMask = (h.subBucketCount - 1) << h.unitMagnitude
+
+	// Each bucket doubles the range of values that can be recorded.
+	smallestUntrackable := h.subBucketCount << h.unitMagnitude
+	buckets := int64(1)
+	for smallestUntrackable <= highest {
+		if smallestUntrackable > math.MaxInt64/2 {
+			buckets++
+			break
+		}
+
+		smallestUntrackable <<= 1
+		buckets++
+	}
+
+	h.counts = make([]int64, (buckets+1)*h.subBucketHalfCount)
+
+	h.Reset()
+
+	return h
+}
+
+// Reset removes all recorded values.
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+
+	h.total = 0
+	h.sum = 0
+	h.min = math.MaxInt64
+	h.max = 0
+}
+
+// Record records a single value.
+func (h *Histogram) Record(v int64) {
+	h.RecordN(v, 1)
+}
+
+// RecordN records a value `n` times.
+func (h *Histogram) RecordN(v, n int64) {
+	if v < 0 {
+		v = 0
+	} else if v > h.highest {
+		v = h.highest
+	}
+
+	h.counts[h.index(v)] += n
+	h.total += n
+	h.sum += float64(v) * float64(n)
+
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Merge adds all values recorded in `o` to this histogram.
+// Both histograms must have been created with the same arguments.
+func (h *Histogram) Merge(o *Histogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+
+	h.total += o.total
+	h.sum += o.sum
+
+	if o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// Counts contains the values recorded in a histogram in a form that can be
+// encoded, for example to send it to another process.
+type Counts struct {
+	// The non-zero counts by their index in the histogram.
+	Counts map[int]int64 `json:"counts"`
+	Sum    float64       `json:"sum"`
+	Min    int64         `json:"min"`
+	Max    int64         `json:"max"`
+}
+
+// Counts returns the values recorded in the histogram.
+func (h *Histogram) Counts() Counts {
+	c := Counts{
+		Counts: make(map[int]int64, 0),
+		Sum:    h.sum,
+		Min:    h.Min(),
+		Max:    h.max,
+	}
+
+	for i, n := range h.counts {
+		if n > 0 {
+			c.Counts[i] = n
+		}
+	}
+
+	return c
+}
+
+// AddCounts adds values as returned by Counts to this histogram.
+// Both histograms must have been created with the same arguments.
+func (h *Histogram) AddCounts(c Counts) error {
+	for i := range c.Counts {
+		if i < 0 || i >= len(h.counts) {
+			return fmt.Errorf("count index %d out of range", i)
+		}
+	}
+
+	total := int64(0)
+
+	for i, n := range c.Counts {
+		h.counts[i] += n
+		total += n
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	h.total += total
+	h.sum += c.Sum
+
+	if c.Min < h.min {
+		h.min = c.Min
+	}
+	if c.Max > h.max {
+		h.max = c.Max
+	}
+
+	return nil
+}
+
+// Snapshot returns a copy of the histogram.
+func (h *Histogram) Snapshot() *Histogram {
+	s := *h
+	s.counts = make([]int64, len(h.counts))
+	copy(s.counts, h.counts)
+
+	return &s
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Min returns the lowest recorded value.
+func (h *Histogram) Min() int64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	return h.min
+}
+
+// Max returns the highest recorded value.
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+// Mean returns the mean of all recorded values.
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	return h.sum / float64(h.total)
+}
+
+// Quantile returns the value at quantile `q` (between 0 and 1).
+// The result is accurate up to the number of significant digits of the
+// histogram.
+func (h *Histogram) Quantile(q float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	if q >= 1 {
+		return h.max
+	} else if q < 0 {
+		q = 0
+	}
+
+	target := int64(q*float64(h.total) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+
+	seen := int64(0)
+	for i, n := range h.counts {
+		seen += n
+
+		if seen >= target {
+			v := h.highestEquivalent(h.valueFromIndex(i))
+			if v > h.max {
+				v = h.max
+			}
+
+			return v
+		}
+	}
+
+	return h.max
+}
+
+func (h *Histogram) bucketIndex(v int64) int {
+	pow2Ceiling := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask))
+
+	return pow2Ceiling - int(h.unitMagnitude) - int(h.subBucketHalfCountMagnitude+1)
+}
+
+func (h *Histogram) index(v int64) int {
+	bucket := h.bucketIndex(v)
+	subBucket := v >> (uint(bucket) + h.unitMagnitude)
+
+	return int((int64(bucket+1) << h.subBucketHalfCountMagnitude) + subBucket - h.subBucketHalfCount)
+}
+
+func (h *Histogram) valueFromIndex(i int) int64 {
+	bucket := (i >> h.subBucketHalfCountMagnitude) - 1
+	subBucket := int64(i)&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+
+	if bucket < 0 {
+		subBucket -= h.subBucketHalfCount
+		bucket = 0
+	}
+
+	return subBucket << (uint(bucket) + h.unitMagnitude)
+}
+
+// highestEquivalent returns the highest value that is recorded in the same
+// bucket as `v`.
+func (h *Histogram) highestEquivalent(v int64) int64 {
+	shift := uint(h.bucketIndex(v)) + h.unitMagnitude
+
+	return (v>>shift)<<shift + (int64(1) << shift) - 1
+}
@@ -0,0 +1,115 @@
+package histogram
+
+import (
+	"math"
+	"testing"
+)
+
+func within(v, expected int64, digits int) bool {
+	return math.Abs(float64(v-expected)) <= float64(expected)/math.Pow10(digits-1)
+}
+
+func TestQuantile(t *testing.T) {
+	h := New(1, 3600*1000*1000, 3)
+
+	for i := int64(1); i <= 100000; i++ {
+		h.Record(i)
+	}
+
+	if h.Count() != 100000 {
+		t.Fatalf("expected 100000 values not %d", h.Count())
+	}
+
+	for _, q := range []float64{0.5, 0.75, 0.9, 0.99, 0.999} {
+		expected := int64(q * 100000)
+
+		if v := h.Quantile(q); !within(v, expected, 3) {
+			t.Fatalf("expected quantile %v to be %d not %d", q, expected, v)
+		}
+	}
+
+	if v := h.Quantile(1); v != 100000 {
+		t.Fatalf("expected the maximum to be 100000 not %d", v)
+	}
+	if v := h.Min(); v != 1 {
+		t.Fatalf("expected the minimum to be 1 not %d", v)
+	}
+	if v := h.Mean(); v != 50000.5 {
+		t.Fatalf("expected the mean to be 50000.5 not %v", v)
+	}
+}
+
+func TestHighest(t *testing.T) {
+	h := New(1000, 1000000, 2)
+
+	h.Record(5000000)
+
+	if v := h.Max(); v != 1000000 {
+		t.Fatalf("expected values above the highest value to be clamped, got %d", v)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := New(1, 1000000, 3)
+	b := New(1, 1000000, 3)
+
+	for i := int64(1); i <= 1000; i++ {
+		a.Record(i)
+		b.Record(i + 1000)
+	}
+
+	s := a.Snapshot()
+	s.Merge(b)
+
+	if s.Count() != 2000 {
+		t.Fatalf("expected 2000 values not %d", s.Count())
+	}
+	if a.Count() != 1000 {
+		t.Fatalf("expected the snapshot to be independent, got %d values", a.Count())
+	}
+	if v := s.Quantile(0.5); !within(v, 1000, 3) {
+		t.Fatalf("expected the median to be 1000 not %d", v)
+	}
+	if v := s.Max(); v != 2000 {
+		t.Fatalf("expected the maximum to be 2000 not %d", v)
+	}
+}
+
+func TestAddCounts(t *testing.T) {
+	a := New(1, 1000000, 3)
+	b := New(1, 1000000, 3)
+
+	for i := int64(1); i <= 1000; i++ {
+		a.Record(i)
+		b.Record(i + 1000)
+	}
+
+	if err := a.AddCounts(b.Counts()); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Count() != 2000 {
+		t.Fatalf("expected 2000 values not %d", a.Count())
+	}
+	if v := a.Mean(); v != 1000.5 {
+		t.Fatalf("expected the mean to be 1000.5 not %v", v)
+	}
+	if v := a.Min(); v != 1 {
+		t.Fatalf("expected the minimum to be 1 not %d", v)
+	}
+	if v := a.Max(); v != 2000 {
+		t.Fatalf("expected the maximum to be 2000 not %d", v)
+	}
+
+	// Empty histograms don't change the minimum.
+	if err := a.AddCounts(New(1, 1000000, 3).Counts()); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.Min(); v != 1 {
+		t.Fatalf("expected the minimum to be 1 not %d", v)
+	}
+
+	if err := New(1, 1000, 1).AddCounts(a.Counts()); err == nil {
+		t.Fatal("expected counts of a larger histogram to be rejected")
+	}
+}
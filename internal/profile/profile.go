@@ -0,0 +1,165 @@
+package profile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of stages a profile can contain.
+const (
+	// Ramp linearly changes the rate from the current rate to Rate.
+	Ramp = "ramp"
+	// Hold keeps the current rate.
+	Hold = "hold"
+	// Step changes the rate to Rate.
+	Step = "step"
+	// Spike changes the rate to Rate and returns to the previous rate after.
+	Spike = "spike"
+)
+
+// Stage is a single stage of a load profile.
+type Stage struct {
+	Kind     string
+	Rate     float64
+	Duration time.Duration
+}
+
+func (s Stage) String() string {
+	if s.Kind == Hold {
+		return s.Kind + ":" + s.Duration.String()
+	}
+
+	return s.Kind + ":" + strconv.FormatFloat(s.Rate, 'f', -1, 64) + ":" + s.Duration.String()
+}
+
+// Validate checks if the stage is valid.
+func (s Stage) Validate() error {
+	switch s.Kind {
+	case Ramp, Hold, Step, Spike:
+	default:
+		return fmt.Errorf("unknown stage: %s", s.Kind)
+	}
+
+	if s.Rate < 0 {
+		return fmt.Errorf("negative rate in stage: %v", s)
+	}
+	if s.Duration <= 0 {
+		return fmt.Errorf("stage without duration: %v", s)
+	}
+
+	return nil
+}
+
+// Parse parses a comma separated list of stages.
+// Each stage is formatted as kind:rate:duration, for example:
+//
+//	ramp:500:60s,hold:5m,spike:2000:10s
+//
+// The hold stage doesn't have a rate.
+func Parse(s string) ([]Stage, error) {
+	stages := make([]Stage, 0)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Split(part, ":")
+
+		stage := Stage{
+			Kind: fields[0],
+		}
+
+		var duration string
+
+		if stage.Kind == Hold {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid stage: %s", part)
+			}
+
+			duration = fields[1]
+		} else {
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("invalid stage: %s", part)
+			}
+
+			rate, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate in stage: %s", part)
+			}
+
+			stage.Rate = rate
+			duration = fields[2]
+		}
+
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in stage: %s", part)
+		}
+
+		stage.Duration = d
+
+		if err := stage.Validate(); err != nil {
+			return nil, err
+		}
+
+		stages = append(stages, stage)
+	}
+
+	return stages, nil
+}
+
+// Profile calculates the target rate over time.
+type Profile struct {
+	start  float64
+	stages []Stage
+}
+
+// New creates a new profile starting at rate `start`.
+func New(start float64, stages []Stage) *Profile {
+	return &Profile{
+		start:  start,
+		stages: stages,
+	}
+}
+
+// Duration returns the total duration of the profile.
+func (p *Profile) Duration() time.Duration {
+	total := time.Duration(0)
+
+	for _, s := range p.stages {
+		total += s.Duration
+	}
+
+	return total
+}
+
+// Rate returns the target rate `elapsed` after the start of the profile.
+// It returns false when all stages are done.
+func (p *Profile) Rate(elapsed time.Duration) (float64, bool) {
+	rate := p.start
+
+	for _, s := range p.stages {
+		if elapsed < s.Duration {
+			switch s.Kind {
+			case Ramp:
+				return rate + (s.Rate-rate)*(float64(elapsed)/float64(s.Duration)), true
+			case Step, Spike:
+				return s.Rate, true
+			default:
+				return rate, true
+			}
+		}
+
+		elapsed -= s.Duration
+
+		if s.Kind == Ramp || s.Kind == Step {
+			rate = s.Rate
+		}
+	}
+
+	return rate, false
+}
@@ -0,0 +1,68 @@
+package profile
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	stages, err := Parse("ramp:500:60s, hold:5m,spike:2000:10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Stage{
+		{Kind: Ramp, Rate: 500, Duration: time.Minute},
+		{Kind: Hold, Duration: 5 * time.Minute},
+		{Kind: Spike, Rate: 2000, Duration: 10 * time.Second},
+	}
+
+	if len(stages) != len(expected) {
+		t.Fatalf("expected %d stages not %d", len(expected), len(stages))
+	}
+
+	for i, s := range stages {
+		if s != expected[i] {
+			t.Fatalf("expected stage %d to be %v not %v", i, expected[i], s)
+		}
+	}
+
+	for _, invalid := range []string{"ramp:500", "hold:10s:5", "jump:10:10s", "step:-1:10s", "step:10:0s", "hold:x"} {
+		if _, err := Parse(invalid); err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	p := New(0, []Stage{
+		{Kind: Ramp, Rate: 500, Duration: time.Minute},
+		{Kind: Hold, Duration: 5 * time.Minute},
+		{Kind: Spike, Rate: 2000, Duration: 10 * time.Second},
+		{Kind: Hold, Duration: 10 * time.Second},
+	})
+
+	tests := []struct {
+		elapsed time.Duration
+		rate    float64
+		running bool
+	}{
+		{0, 0, true},
+		{30 * time.Second, 250, true},
+		{time.Minute, 500, true},
+		{6*time.Minute + 5*time.Second, 2000, true},
+		{6*time.Minute + 15*time.Second, 500, true},
+		{7 * time.Minute, 500, false},
+	}
+
+	for _, test := range tests {
+		rate, running := p.Rate(test.elapsed)
+		if rate != test.rate || running != test.running {
+			t.Fatalf("expected %v, %v at %v not %v, %v", test.rate, test.running, test.elapsed, rate, running)
+		}
+	}
+
+	if d := p.Duration(); d != 6*time.Minute+20*time.Second {
+		t.Fatalf("expected a duration of %v not %v", 6*time.Minute+20*time.Second, d)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"time"
 )
 
+// idle is how long Try asks to wait when no actions are allowed at all.
+const idle = 10 * time.Millisecond
+
 type Limiter struct {
 	rate float64
 	per  float64
@@ -60,6 +63,27 @@ func (l *Limiter) Set(rate float64, per time.Duration) {
 	l.m.Unlock()
 }
 
+// Rate returns the number of actions allowed per duration.
+func (l *Limiter) Rate() float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.rate
+}
+
+// Interval returns the time between two actions at the current rate.
+// It returns 0 when no actions are allowed.
+func (l *Limiter) Interval() time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(l.per / l.rate)
+}
+
 // Left returns how many actions this limiter has left.
 func (l *Limiter) Left() float64 {
 	left := float64(0)
@@ -90,7 +114,13 @@ func (l *Limiter) Try() (bool, time.Duration) {
 	l.last = now
 	l.left += l.rate * (d / l.per)
 
-	if l.left > l.rate {
+	if l.rate <= 0 {
+		// No actions are allowed, check again after a while as the rate
+		// might change.
+		l.left = 0
+		limit = true
+		duration = idle
+	} else if l.left > l.rate {
 		l.left = l.rate - 1
 	} else if l.left >= 1 {
 		l.left -= 1
@@ -20,3 +20,26 @@ func TestWait(t *testing.T) {
 		t.Fatalf("waited for %v instead of %v", waited, time.Millisecond*500)
 	}
 }
+
+func TestInterval(t *testing.T) {
+	l := New(4, time.Second, 0)
+	if interval := l.Interval(); interval != time.Millisecond*250 {
+		t.Fatalf("expected an interval of %v not %v", time.Millisecond*250, interval)
+	}
+
+	l.Set(0, time.Second)
+	if interval := l.Interval(); interval != 0 {
+		t.Fatalf("expected an interval of 0 not %v", interval)
+	}
+}
+
+func TestZeroRate(t *testing.T) {
+	l := New(0, time.Second, 0)
+	limit, wait := l.Try()
+	if !limit {
+		t.Fatalf("expected we need to limit")
+	}
+	if wait != idle {
+		t.Fatalf("expected to wait for %v not %v", idle, wait)
+	}
+}
@@ -0,0 +1,181 @@
+package threshold
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of metrics a threshold can be set on.
+const (
+	// Latency metrics are in milliseconds.
+	Latency = iota
+	// Ratio metrics are between 0 and 1.
+	Ratio
+	// Number metrics are plain numbers like counts.
+	Number
+)
+
+var metrics = map[string]int{
+	"min":        Latency,
+	"mean":       Latency,
+	"max":        Latency,
+	"error_rate": Ratio,
+	"rps":        Number,
+	"requests":   Number,
+	"errors":     Number,
+	"late":       Number,
+	"dropped":    Number,
+}
+
+// Ordered so the longest operators are matched first.
+var operators = []string{"<=", ">=", "==", "<", ">"}
+
+// Threshold is a condition on a metric of the final statistics.
+type Threshold struct {
+	Metric string
+	Op     string
+	Value  float64
+}
+
+// Kind returns the kind of metric of the threshold.
+func (t Threshold) Kind() int {
+	return kind(t.Metric)
+}
+
+func kind(metric string) int {
+	if k, ok := metrics[metric]; ok {
+		return k
+	}
+
+	// Percentiles like p99 and p99.9 are latencies.
+	return Latency
+}
+
+// Percentile returns the percentile of a percentile metric like p99.9 and
+// false for all other metrics.
+func (t Threshold) Percentile() (float64, bool) {
+	return percentile(t.Metric)
+}
+
+func percentile(metric string) (float64, bool) {
+	if !strings.HasPrefix(metric, "p") {
+		return 0, false
+	}
+
+	p, err := strconv.ParseFloat(metric[1:], 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, false
+	}
+
+	return p, true
+}
+
+// Format formats a value of the metric of the threshold.
+func (t Threshold) Format(v float64) string {
+	switch t.Kind() {
+	case Latency:
+		return time.Duration(v * float64(time.Millisecond)).String()
+	case Ratio:
+		return strconv.FormatFloat(v*100, 'f', -1, 64) + "%"
+	default:
+		if v == float64(int64(v)) {
+			return strconv.FormatInt(int64(v), 10)
+		}
+
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+}
+
+func (t Threshold) String() string {
+	return t.Metric + t.Op + t.Format(t.Value)
+}
+
+// Check returns true if the value passes the threshold.
+func (t Threshold) Check(v float64) bool {
+	switch t.Op {
+	case "<":
+		return v < t.Value
+	case "<=":
+		return v <= t.Value
+	case ">":
+		return v > t.Value
+	case ">=":
+		return v >= t.Value
+	default:
+		return v == t.Value
+	}
+}
+
+// Parse parses a single threshold like p99<200ms, error_rate<1% or rps>=450.
+// Latencies are durations, ratios can be percentages or fractions.
+func Parse(s string) (Threshold, error) {
+	s = strings.TrimSpace(s)
+
+	for _, op := range operators {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+
+		t := Threshold{
+			Metric: strings.TrimSpace(s[:i]),
+			Op:     op,
+		}
+
+		if _, ok := metrics[t.Metric]; !ok {
+			if _, ok := percentile(t.Metric); !ok {
+				return t, fmt.Errorf("unknown metric in threshold: %s", s)
+			}
+		}
+
+		value := strings.TrimSpace(s[i+len(op):])
+
+		var err error
+
+		switch t.Kind() {
+		case Latency:
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			t.Value = float64(d) / float64(time.Millisecond)
+		case Ratio:
+			if strings.HasSuffix(value, "%") {
+				t.Value, err = strconv.ParseFloat(value[:len(value)-1], 64)
+				t.Value /= 100
+			} else {
+				t.Value, err = strconv.ParseFloat(value, 64)
+			}
+		default:
+			t.Value, err = strconv.ParseFloat(value, 64)
+		}
+
+		if err != nil {
+			return t, fmt.Errorf("invalid value in threshold: %s", s)
+		}
+
+		return t, nil
+	}
+
+	return Threshold{}, fmt.Errorf("invalid threshold: %s", s)
+}
+
+// ParseList parses a comma separated list of thresholds.
+func ParseList(s string) ([]Threshold, error) {
+	thresholds := make([]Threshold, 0)
+
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		t, err := Parse(part)
+		if err != nil {
+			return nil, err
+		}
+
+		thresholds = append(thresholds, t)
+	}
+
+	return thresholds, nil
+}
@@ -0,0 +1,50 @@
+package threshold
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Threshold
+	}{
+		{"p99<200ms", Threshold{Metric: "p99", Op: "<", Value: 200}},
+		{"p99.9 <= 1.5s", Threshold{Metric: "p99.9", Op: "<=", Value: 1500}},
+		{"error_rate<1%", Threshold{Metric: "error_rate", Op: "<", Value: 0.01}},
+		{"error_rate<0.05", Threshold{Metric: "error_rate", Op: "<", Value: 0.05}},
+		{"rps>=450", Threshold{Metric: "rps", Op: ">=", Value: 450}},
+		{"errors==0", Threshold{Metric: "errors", Op: "==", Value: 0}},
+	}
+
+	for _, test := range tests {
+		th, err := Parse(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if th != test.expected {
+			t.Fatalf("expected %q to be %+v not %+v", test.s, test.expected, th)
+		}
+	}
+
+	for _, invalid := range []string{"p99", "p101<1s", "foo<1", "p99<200", "rps>=fast"} {
+		if _, err := Parse(invalid); err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	thresholds, err := ParseList("p99<200ms, rps>=450")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !thresholds[0].Check(199) || thresholds[0].Check(200) {
+		t.Fatalf("expected %v to only pass below 200", thresholds[0])
+	}
+	if !thresholds[1].Check(450) || thresholds[1].Check(449.9) {
+		t.Fatalf("expected %v to only pass from 450", thresholds[1])
+	}
+}
@@ -1,23 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"os/signal"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/cjoudrey/gluahttp"
 	"github.com/cjoudrey/gluaurl"
 	"github.com/erikdubbelboer/hench/internal/ratelimit"
 	"github.com/yuin/gopher-lua"
@@ -26,19 +26,37 @@ import (
 )
 
 var (
-	L     *lua.LState
-	LLock sync.Mutex
+	resultChan = make(chan result, 0)
 
-	durationChan = make(chan time.Duration, 0)
+	// Requests intended to start before warmupEnd are not part of the
+	// statistics and don't count towards maxRequests.
+	warmupEnd time.Time
 
-	errorsN = uint64(0)
+	// When maxRequests is not 0 the run stops after this many requests.
+	maxRequests = uint64(0)
+	issuedN     = uint64(0)
+	finishedN   = uint64(0)
 
-	client *http.Client
+	// The client exists before the Lua states are created as the http module
+	// uses it. The transport is set once the TLS configuration of the script
+	// is known.
+	client = &http.Client{}
 
 	rate *ratelimit.Limiter
 
 	start sync.WaitGroup
 	stop  = make(chan lua.LValue, 0)
+
+	// finishing is closed when no new requests should be started, for example
+	// when a feeder is exhausted. The run stops when the workers are done.
+	finishing = make(chan struct{}, 0)
+
+	// runCtx is canceled when the run is stopped so requests that are in
+	// flight are canceled as well.
+	runCtx, cancelRun = context.WithCancel(context.Background())
+
+	// The timeout for requests that don't set their own timeout.
+	defaultTimeout time.Duration
 )
 
 func luaPrint(L *lua.LState) int {
@@ -61,19 +79,131 @@ func luaExit(L *lua.LState) int {
 }
 
 func luaStop(L *lua.LState) int {
+	stopRun()
+
+	return 0
+}
+
+// stopped returns true if the run is stopped.
+func stopped() bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopRun stops all workers.
+// This might be called multiple times, for example when a script calls stop()
+// while the user pressed Ctrl+C. To prevent a panic we wrap the close in a
+// recover.
+func stopRun() {
 	defer func() {
 		recover()
 	}()
 
 	close(stop)
+	cancelRun()
+}
 
-	return 0
+// finishRun lets the workers finish their requests and stops the run when
+// they are all done. Like stopRun it can be called multiple times.
+func finishRun() {
+	defer func() {
+		recover()
+	}()
+
+	close(finishing)
+}
+
+// luaState is a Lua state that can be used by multiple workers.
+type luaState struct {
+	sync.Mutex
+
+	L *lua.LState
 }
 
-func buildRequest(stateName string) *http.Request {
-	LLock.Lock()
-	defer LLock.Unlock()
+// newLuaState creates a new Lua state and runs the script in it.
+// Without a script the default script that requests args[1] is used.
+func newLuaState(script string, args []string) *luaState {
+	L := lua.NewState()
+	L.OpenLibs()
+	L.Register("print", luaPrint)
+	L.Register("println", luaPrintln)
+	L.Register("exit", luaExit)
+	L.Register("stop", luaStop)
+	L.Register("sleep", luaSleep)
+
+	L.PreloadModule("http", httpLoader)
+	L.PreloadModule("json", gluajson.Loader)
+	L.PreloadModule("url", gluaurl.Loader)
+	L.PreloadModule("shared", sharedLoader)
+	L.PreloadModule("feeder", feederLoader)
+	L.PreloadModule("cookies", cookiesLoader)
+
+	argsTable := L.NewTable()
+	for _, arg := range args {
+		argsTable.Append(lua.LString(arg))
+	}
+	L.SetGlobal("args", argsTable)
 
+	if script == "" && replay != nil {
+		if err := L.DoString(replayScript); err != nil {
+			log.Fatal(err)
+		}
+	} else if script == "" {
+		if err := L.DoString(`
+			if #args == 0 then
+				println('No url given')
+				exit(1)
+			end
+
+			function request(state)
+				return {
+					['method' ] = 'GET',
+					['url'    ] = args[1],
+					['headers'] = {
+						['User-Agent'] = 'hench',
+					}
+				}
+			end
+
+			function response(res, state)
+				return res.status == 200
+			end
+		`); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if err := L.DoFile(script); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return &luaState{L: L}
+}
+
+// request is a request built by the script.
+type request struct {
+	*http.Request
+
+	// The statistics are also collected per tag.
+	tag string
+
+	timeout time.Duration
+
+	// The worker performing the request.
+	worker int
+}
+
+func buildRequest(ls *luaState, stateName string) *request {
+	ls.Lock()
+	defer ls.Unlock()
+
+	L := ls.L
+
+	called := time.Now()
 	if err := L.CallByParam(lua.P{
 		Fn:      L.GetGlobal("request"),
 		NRet:    1,
@@ -81,22 +211,50 @@ func buildRequest(stateName string) *http.Request {
 	}, L.GetGlobal(stateName)); err != nil {
 		log.Fatal(err)
 	}
+	observeCallback("request", time.Since(called))
 
 	tableVal := L.Get(-1)
+	L.Pop(1)
 
 	if tableVal.Type() != lua.LTTable {
 		return nil
 	}
 
-	table := tableVal.(*lua.LTable)
+	return requestFromTable(ls, tableVal.(*lua.LTable))
+}
 
+// requestFromTable builds the request described by a table returned by the
+// script. The lock of the state should be held.
+func requestFromTable(ls *luaState, table *lua.LTable) *request {
 	method := table.RawGet(lua.LString("method"))
 	url := table.RawGet(lua.LString("url"))
 	body := table.RawGet(lua.LString("body"))
 
+	if method.Type() == lua.LTNil {
+		method = lua.LString("GET")
+	}
+
+	bodyFile := table.RawGet(lua.LString("body_file"))
+	parts := table.RawGet(lua.LString("multipart"))
+
+	sources := 0
+	for _, v := range []lua.LValue{body, bodyFile, parts} {
+		if v.Type() != lua.LTNil {
+			sources++
+		}
+	}
+	if sources > 1 {
+		log.Fatal("only one of body, body_file and multipart can be used")
+	}
+
 	var bodyReader io.Reader
 
-	if body.Type() != lua.LTNil {
+	switch b := body.(type) {
+	case *lua.LNilType:
+	case *lua.LFunction:
+		// Chunked as the length isn't known.
+		bodyReader = &bodyGenerator{ls: ls, fn: b}
+	default:
 		bodyReader = strings.NewReader(body.String())
 	}
 
@@ -105,6 +263,17 @@ func buildRequest(stateName string) *http.Request {
 		log.Fatal(err)
 	}
 
+	if bodyFile.Type() != lua.LTNil {
+		fileBody(req, bodyFile.String())
+	}
+
+	contentType := ""
+	if p, ok := parts.(*lua.LTable); ok {
+		contentType = multipartBody(req, multipartParts(p))
+	} else if parts.Type() != lua.LTNil {
+		log.Fatal("multipart should be a table with the parts")
+	}
+
 	headers := table.RawGet(lua.LString("headers"))
 
 	if h, ok := headers.(*lua.LTable); ok {
@@ -113,21 +282,51 @@ func buildRequest(stateName string) *http.Request {
 		})
 	}
 
-	L.Pop(1)
+	if contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
-	return req
-}
+	// Both name and tag can be used to set the tag.
+	tag := table.RawGet(lua.LString("name"))
+	if tag.Type() == lua.LTNil {
+		tag = table.RawGet(lua.LString("tag"))
+	}
 
-func handleResponse(res *http.Response, stateName string) {
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Fatal(err)
+	r := &request{
+		Request: req,
+		timeout: defaultTimeout,
 	}
-	res.Body.Close()
 
-	LLock.Lock()
-	defer LLock.Unlock()
+	// The timeout can be a number of seconds or a duration string.
+	switch timeout := table.RawGet(lua.LString("timeout")).(type) {
+	case lua.LNumber:
+		r.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	case lua.LString:
+		if r.timeout, err = time.ParseDuration(string(timeout)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if tag.Type() != lua.LTNil {
+		r.tag = tag.String()
+	} else {
+		r.tag = defaultTag(req.Method, req.URL)
+	}
 
+	return r
+}
+
+// handleResponse calls the response function of the script and returns if
+// the request was a success.
+func handleResponse(ls *luaState, res *http.Response, body []byte, r result, stateName string) bool {
+	ls.Lock()
+	defer ls.Unlock()
+
+	return callResponse(ls.L, responseTable(ls.L, res, body, r), stateName)
+}
+
+// responseTable returns the table passed to the script for a response.
+func responseTable(L *lua.LState, res *http.Response, body []byte, r result) *lua.LTable {
 	headers := L.NewTable()
 
 	for name, values := range res.Header {
@@ -143,9 +342,20 @@ func handleResponse(res *http.Response, stateName string) {
 	table := L.NewTable()
 
 	table.RawSet(lua.LString("status"), lua.LNumber(res.StatusCode))
+	table.RawSet(lua.LString("proto"), lua.LString(res.Proto))
 	table.RawSet(lua.LString("body"), lua.LString(body))
 	table.RawSet(lua.LString("headers"), headers)
+	table.RawSet(lua.LString("timings"), r.phases.luaTable(L))
+	table.RawSet(lua.LString("zero_rtt"), lua.LBool(r.zeroRTT))
+	table.RawSet(lua.LString("remote_addr"), lua.LString(r.remoteAddr))
 
+	return table
+}
+
+// callResponse calls the response function of the script and returns if the
+// request was a success.
+func callResponse(L *lua.LState, table *lua.LTable, stateName string) bool {
+	called := time.Now()
 	if err := L.CallByParam(lua.P{
 		Fn:      L.GetGlobal("response"),
 		NRet:    1,
@@ -153,22 +363,35 @@ func handleResponse(res *http.Response, stateName string) {
 	}, table, L.GetGlobal(stateName)); err != nil {
 		log.Fatal(err)
 	}
+	observeCallback("response", time.Since(called))
 
-	if ok := L.Get(-1); ok.Type() != lua.LTBool || !bool(ok.(lua.LBool)) {
-		atomic.AddUint64(&errorsN, 1)
-	}
-
+	ok := L.Get(-1)
 	L.Pop(1)
+
+	return ok.Type() == lua.LTBool && bool(ok.(lua.LBool))
 }
 
-func worker(n int) {
+func worker(n int, ls *luaState) {
 	stateName := "__state" + strconv.FormatInt(int64(n), 10)
 
-	LLock.Lock()
+	atomic.AddInt64(&workersN, 1)
+	defer atomic.AddInt64(&workersN, -1)
+
+	// Scripts with a scenario function run it instead of request.
+	scenario := false
+
+	ls.Lock()
 	{
-		L.SetGlobal(stateName, L.CreateTable(0, 0))
+		L := ls.L
+
+		state := L.CreateTable(0, 0)
+		L.SetGlobal(stateName, state)
+		registerState(state, n)
+
+		scenario = L.GetGlobal("scenario").Type() == lua.LTFunction
 
 		if workerCb := L.GetGlobal("worker"); workerCb.Type() == lua.LTFunction {
+			called := time.Now()
 			if err := L.CallByParam(lua.P{
 				Fn:      workerCb,
 				NRet:    0,
@@ -176,168 +399,554 @@ func worker(n int) {
 			}, L.GetGlobal(stateName)); err != nil {
 				log.Fatal(err)
 			}
+			observeCallback("worker", time.Since(called))
 		}
 	}
-	LLock.Unlock()
+	ls.Unlock()
 
 	start.Wait()
 
 	for {
-		for {
-			limit, sleep := rate.Try()
-			if !limit {
-				select {
-				case <-stop:
-					return
-				default:
-				}
+		select {
+		case <-finishing:
+			return
+		default:
+		}
+
+		var req *request
+		var intended time.Time
 
-				break
+		if replay != nil {
+			var ok bool
+			if req, intended, ok = replay.wait(); !ok {
+				return
+			}
+		} else if scenario {
+			if !runScenario(n, ls, stateName) {
+				return
 			}
 
-			select {
-			case <-stop:
+			continue
+		} else {
+			var ok bool
+			if intended, ok = waitTurn(); !ok {
 				return
-			case <-time.After(sleep):
+			}
+
+			if req = buildRequest(ls, stateName); req == nil {
+				continue
 			}
 		}
 
-		req := buildRequest(stateName)
-		if req == nil {
-			continue
+		ok := perform(n, req, intended, func(r *result, res *http.Response, body []byte) {
+			if res != nil && !handleResponse(ls, res, body, *r, stateName) {
+				r.failed = true
+				r.errorClass = errorRejected
+			}
+		})
+		if !ok {
+			return
 		}
 
-		startTime := time.Now()
+		if replay != nil {
+			replay.finish()
+		}
+	}
+}
 
-		if res, err := client.Do(req); err != nil {
-			atomic.AddUint64(&errorsN, 1)
-		} else {
-			durationChan <- time.Now().Sub(startTime)
+// perform performs a request for worker n and records the result. Before the
+// result is recorded it's passed to handle with the response, which is nil
+// when the request failed. It returns false when the worker should stop.
+func perform(n int, req *request, intended time.Time, handle func(r *result, res *http.Response, body []byte)) bool {
+	req.worker = n
+	startTime := time.Now()
 
-			handleResponse(res, stateName)
+	// With the open-loop model the latency is measured from the intended
+	// start time so time spent waiting for a free worker is included.
+	if intended.IsZero() {
+		intended = startTime
+	} else if startTime.Sub(intended) > lateThreshold {
+		atomic.AddUint64(&lateN, 1)
+	}
+
+	warmup := intended.Before(warmupEnd)
+	counted := !warmup && maxRequests > 0
+
+	if counted && atomic.AddUint64(&issuedN, 1) > maxRequests {
+		if req.Body != nil {
+			req.Body.Close()
 		}
+
+		// Enough requests have been started, wait for the last ones to finish.
+		<-stop
+		return false
 	}
+
+	atomic.AddInt64(&inFlightN, 1)
+	r, res, body := doRequest(req, intended, startTime)
+	atomic.AddInt64(&inFlightN, -1)
+	r.tag = req.tag
+	r.warmup = warmup
+
+	handle(&r, res, body)
+
+	// Requests that finish after we stopped are ignored.
+	if r.stopped {
+		return false
+	}
+
+	resultChan <- r
+
+	if counted && atomic.AddUint64(&finishedN, 1) == maxRequests {
+		stopRun()
+	}
+
+	return true
+}
+
+// doRequest performs the request. The response is only returned when the
+// body was read.
+func doRequest(req *request, intended, startTime time.Time) (result, *http.Response, []byte) {
+	var r result
+
+	ctx := runCtx
+	if req.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.timeout)
+		defer cancel()
+	}
+
+	t := &requestTrace{start: startTime}
+	ctx = httptrace.WithClientTrace(ctx, t.clientTrace())
+	ctx = withRequestTrace(ctx, t)
+	ctx = withWorker(ctx, req.worker)
+
+	hreq := req.WithContext(ctx)
+
+	if _, ok := hreq.Body.(*os.File); ok {
+		t.fileSize = hreq.ContentLength
+	} else if hreq.Body != nil && hreq.Body != http.NoBody {
+		t.upload = &uploadBody{ReadCloser: hreq.Body}
+		hreq.Body = t.upload
+	}
+
+	res, err := clientFor(req.worker).Do(hreq)
+	if err != nil {
+		t.fill(&r)
+		r.failed = true
+		r.errorClass = classifyError(err)
+		r.stopped = stopped()
+		return r, nil, nil
+	}
+
+	t.headers = time.Now()
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	r.stopped = stopped()
+	if err != nil {
+		t.fill(&r)
+		r.failed = true
+		r.errorClass = classifyError(err)
+		return r, nil, nil
+	}
+
+	t.done = time.Now()
+
+	r.response = true
+	r.status = res.StatusCode
+	r.proto = res.Proto
+	r.latency = t.done.Sub(intended)
+	t.fill(&r)
+
+	return r, res, body
+}
+
+// parsePercentiles parses a comma separated list of percentiles.
+func parsePercentiles(list string) ([]float64, error) {
+	percentiles := make([]float64, 0)
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile: %s", s)
+		}
+
+		percentiles = append(percentiles, p)
+	}
+
+	return percentiles, nil
 }
 
 func main() {
+	// hench agent runs an agent and hench run is the same as hench.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "agent":
+			agentMain(os.Args[2:])
+			return
+		case "run":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	cachedns := flag.Bool("cachedns", true,
-		"Cache dns lookups (dns lookup time is included in the request time and might slow things down)")
+		"Cache dns lookups until their TTL expires (dns lookup time is included in the request time and might slow things down)")
 	rps := flag.Int("rps", 10, "The maximum number of requests per second")
+	openloop := flag.Bool("openloop", false,
+		"Start requests at a constant rate and measure latency from their intended start time")
 	script := flag.String("script", "", "Optional Lua script to run")
 	workers := flag.Int("workers", 100,
 		"Number of workers to use (number of concurrent requests)")
+	states := flag.Int("states", 1,
+		"Number of Lua states to divide the workers over (0 for one state per worker)")
 	keepalive := flag.Bool("keepalive", true, "Use keepalive connections")
+	cookies := flag.Bool("cookies", false,
+		"Give each worker its own cookie jar so cookies set by responses are sent with its next requests")
 	compression := flag.Bool("compression", true, "Enable or disable compression")
+	precision := flag.Int("precision", 3,
+		"Number of significant digits to record latencies with (1 to 5, at most 3 per tag and remote IP)")
+	percentilesList := flag.String("percentiles", "50,75,90,99,100",
+		"Comma separated list of latency percentiles to print")
+	output := flag.String("output", "",
+		"Write the summary and per second samples to this file (as CSV if the name ends in .csv, JSON otherwise)")
+	profileStages := flag.String("profile", "",
+		"Load profile stages, for example: ramp:500:60s,hold:5m,spike:2000:10s (starts at -rps)")
+	runDuration := flag.Duration("duration", 0,
+		"Stop after this duration, excluding the warm-up (0 to run until stopped)")
+	requests := flag.Uint64("requests", 0,
+		"Stop after this many requests, excluding the warm-up (0 to run until stopped)")
+	warmup := flag.Duration("warmup", 0,
+		"Duration at the start that is excluded from the statistics")
+	thresholdsList := flag.String("thresholds", "",
+		"Comma separated list of thresholds like p99<200ms,error_rate<1%,rps>=450 (exits with 3 when breached)")
+	timeout := flag.Duration("timeout", 0,
+		"Timeout for each request including reading the body (0 for no timeout)")
+	proto := flag.String("proto", "http1",
+		"Protocol to use: http1, h2 (HTTP/2 over TLS), h2c (HTTP/2 without TLS), h3 (HTTP/3 over QUIC) or auto (negotiate using TLS)")
+	maxConns := flag.Int("max-conns", 0,
+		"Maximum number of connections per host including connections being dialed (0 for no limit)")
+	h2strict := flag.Bool("h2strict", false,
+		"Wait for a free HTTP/2 stream instead of opening a new connection when the server's stream limit is reached")
+	h2streams := flag.Int("h2streams", 0,
+		"Maximum number of concurrent HTTP/2 streams per host over all its connections, requests wait for a free stream (0 for no limit)")
+	dnsStrategyFlag := flag.String("dnsstrategy", dnsFirst,
+		"How to pick an address when a host has multiple: first, roundrobin, random or sticky (per worker)")
+	dnsPreferFlag := flag.String("dnsprefer", "",
+		"Only use the ipv4 or ipv6 addresses of hosts that have them (empty to use both)")
+	flag.DurationVar(&dnsTTL, "dnsttl", time.Minute,
+		"How long to cache dns lookups when the TTL is unknown, for example for hosts in /etc/hosts")
+	var resolves resolveFlag
+	flag.Var(&resolves, "resolve",
+		"Use an address for a host and port like host:port:address[,address]... (can be repeated)")
+	var tlsFlags tlsOptions
+	flag.StringVar(&tlsFlags.cert, "cert", "", "Client certificate file (PEM)")
+	flag.StringVar(&tlsFlags.key, "key", "", "Client private key file (PEM, defaults to -cert)")
+	flag.StringVar(&tlsFlags.ca, "cacert", "", "CA bundle file (PEM) to verify servers with instead of the system CAs")
+	flag.BoolVar(&tlsFlags.insecure, "insecure", false, "Don't verify the certificate of servers")
+	flag.StringVar(&tlsFlags.serverName, "servername", "",
+		"Server name to send using SNI and to verify the certificate with (defaults to the host of the url)")
+	flag.StringVar(&tlsFlags.minVersion, "tlsmin", "", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsFlags.maxVersion, "tlsmax", "", "Maximum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsFlags.ciphers, "ciphers", "",
+		"Comma separated list of TLS 1.0-1.2 cipher suites, for example: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	flag.BoolVar(&tlsFlags.resumption, "tlsresume", true, "Resume TLS sessions when opening new connections")
+	httpUI := flag.String("http-ui", "",
+		"Address like 127.0.0.1:8089 to serve a dashboard with live charts and controls to change the rps or stop on")
+	replayFile := flag.String("replay", "",
+		"Replay the requests from a HAR file, JSON lines or an access log (urls are sent to the host of the url argument when given)")
+	replaySpeed := flag.Float64("replay-speed", 0,
+		"Replay the requests with their original timing at this speed (2 is twice as fast) instead of as fast as -rps allows")
+	replayLoop := flag.Bool("replay-loop", false, "Start the replay again when all requests are replayed")
+	metricsAddr := flag.String("metrics", "",
+		"Address like :9100 to serve Prometheus metrics on at /metrics")
+	agents := flag.String("agents", "",
+		"Comma separated list of hench agents (started with hench agent) to divide the workers and requests over")
+	agentToken := flag.String("agent-token", os.Getenv("HENCH_AGENT_TOKEN"),
+		"The -token of the agents (defaults to $HENCH_AGENT_TOKEN)")
+	streamRecords := flag.Bool("stream", false,
+		"Write the statistics as JSON lines to file descriptor 3 (used by hench agent)")
+	flag.Float64Var(&rateShare, "share", 1, "The fraction of the rate to generate (used by hench agent)")
 	flag.Parse()
 
-	dial := net.Dial
-	if *cachedns {
-		dial = cacheDial
+	if *streamRecords {
+		stream = json.NewEncoder(os.NewFile(streamFd, "stream"))
 	}
 
-	client = &http.Client{
-		Jar: nil,
-		Transport: &http.Transport{
-			DisableKeepAlives:   !(*keepalive),
-			DisableCompression:  !(*compression),
-			MaxIdleConnsPerHost: *workers,
-			Dial:                dial,
-		},
+	// Flags that are set take precedence over the settings of the script.
+	set := make(map[string]bool, 0)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	defaultTimeout = *timeout
+
+	dnsCacheEnabled = *cachedns
+
+	switch *dnsStrategyFlag {
+	case dnsFirst, dnsRoundRobin, dnsRandom, dnsSticky:
+		dnsStrategy = *dnsStrategyFlag
+	default:
+		log.Fatalf("unknown dns strategy: %s", *dnsStrategyFlag)
 	}
 
-	L = lua.NewState()
-	L.OpenLibs()
-	L.Register("print", luaPrint)
-	L.Register("println", luaPrintln)
-	L.Register("exit", luaExit)
-	L.Register("stop", luaStop)
+	switch *dnsPreferFlag {
+	case "", "ipv4", "ipv6":
+		dnsPrefer = *dnsPreferFlag
+	default:
+		log.Fatalf("unknown ip version: %s", *dnsPreferFlag)
+	}
 
-	L.PreloadModule("http", gluahttp.NewHttpModule(client).Loader)
-	L.PreloadModule("json", gluajson.Loader)
-	L.PreloadModule("url", gluaurl.Loader)
+	for _, r := range resolves {
+		if err := addOverride(r); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	args := L.NewTable()
-	for _, arg := range flag.Args() {
-		args.Append(lua.LString(arg))
+	if *proto == "h3" && *maxConns > 0 {
+		log.Fatal("-max-conns can't be used with -proto h3 which uses one connection per host")
+	}
+	if *h2streams > 0 && *proto != "h2" && *proto != "h2c" && *proto != "auto" {
+		log.Fatal("-h2streams can only be used with -proto h2, h2c or auto")
 	}
-	L.SetGlobal("args", args)
 
-	if *script == "" {
-		if err := L.DoString(`
-			if #args == 0 then
-				println('No url given')
-				exit(1)
-			end
+	percentiles, err := parsePercentiles(*percentilesList)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			function request(state)
-				return {
-					['method' ] = 'GET',
-					['url'    ] = args[1],
-					['headers'] = {
-						['User-Agent'] = 'hench',
-					}
-				}
-			end
+	if *agents != "" {
+		if *metricsAddr != "" {
+			log.Fatal("-metrics can't be used with -agents")
+		}
+		if *replayFile != "" {
+			log.Fatal("-replay can't be used with -agents")
+		}
 
-			function response(res, state)
-				return res.status == 200
-			end
-		`); err != nil {
+		ls := newLuaState(*script, flag.Args())
+
+		target, description, err := loadProfile(*profileStages, float64(*rps), ls)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		thresholds, err := loadThresholds(*thresholdsList, ls)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if target == nil {
+			description = ""
+		}
+
+		runCoordinator(coordinatorConfig{
+			agents:      parseAgents(*agents),
+			token:       *agentToken,
+			script:      *script,
+			args:        flag.Args(),
+			workers:     *workers,
+			requests:    *requests,
+			openloop:    *openloop,
+			profile:     description,
+			thresholds:  thresholds,
+			precision:   *precision,
+			percentiles: percentiles,
+			output:      *output,
+			httpUI:      *httpUI,
+		})
+		return
+	}
+
+	if *metricsAddr != "" {
+		promMetrics = newMetrics()
+	}
+
+	if *replayFile != "" {
+		if replay, err = loadReplay(*replayFile, flag.Arg(0), *replaySpeed, *replayLoop); err != nil {
 			log.Fatal(err)
 		}
+
+		if replay.skipped > 0 {
+			fmt.Printf("skipped %d line(s) of %s that aren't requests\n", replay.skipped, *replayFile)
+		}
+	}
+
+	// Workers are divided over the Lua states. Each state has its own lock
+	// so with more states less time is spent waiting for the script.
+	nstates := *states
+	if nstates <= 0 || nstates > *workers {
+		nstates = *workers
+	}
+
+	luaStates := make([]*luaState, nstates)
+	for i := range luaStates {
+		luaStates[i] = newLuaState(*script, flag.Args())
+	}
+
+	tlsConfig, err := loadTLSConfig(tlsFlags, set, luaStates[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var transport http.RoundTripper
+
+	if *proto == "h3" {
+		transport = newHTTP3Transport(tlsConfig, *keepalive, *compression)
 	} else {
-		if err := L.DoFile(*script); err != nil {
+		t := &http.Transport{
+			DisableKeepAlives:   !(*keepalive),
+			DisableCompression:  !(*compression),
+			MaxIdleConnsPerHost: *workers,
+			MaxConnsPerHost:     *maxConns,
+			DialContext:         resolveDial,
+			TLSClientConfig:     tlsConfig,
+		}
+
+		if err := setProtocols(t, *proto, *h2strict); err != nil {
 			log.Fatal(err)
 		}
+
+		transport = t
+
+		if *h2streams > 0 {
+			transport = newStreamLimit(t, *h2streams)
+		}
+	}
+
+	client.Transport = transport
+
+	if *cookies {
+		setupCookies(*workers, transport)
 	}
 
 	var workersWg sync.WaitGroup
 
 	workersWg.Add(*workers)
 
-	fmt.Printf("starting %d worker(s) for %d requests per second\n", *workers, *rps)
-	fmt.Printf("press Ctrl+C to stop and print statistics\n")
+	target, description, err := loadProfile(*profileStages, float64(*rps), luaStates[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	thresholds, err := loadThresholds(*thresholdsList, luaStates[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if stream == nil {
+		if replay != nil && replay.timed != nil {
+			fmt.Printf("starting %d worker(s) replaying %d request(s) at %gx speed\n", *workers, len(replay.entries), *replaySpeed)
+		} else if target != nil {
+			fmt.Printf("starting %d worker(s) with load profile %s\n", *workers, description)
+		} else {
+			fmt.Printf("starting %d worker(s) for %d requests per second\n", *workers, *rps)
+		}
+		fmt.Printf("press Ctrl+C to stop and print statistics\n")
+	}
 
 	start.Add(1)
 	for i := 0; i < *workers; i++ {
 		go func(i int) {
 			defer workersWg.Done()
-			worker(i)
+			worker(i, luaStates[i%nstates])
 		}(i)
 	}
 
-	rate = ratelimit.New(float64(*rps), time.Second, 0)
+	// Workers only stop by themselves when the run is finishing.
+	go func() {
+		workersWg.Wait()
+		stopRun()
+	}()
+
+	// Agents start when the coordinator says so.
+	var commands *json.Decoder
+	if stream != nil {
+		commands = waitForStart()
+	}
+
+	rate = ratelimit.New(float64(*rps)*rateShare, time.Second, 0)
+
+	if commands != nil {
+		go agentCommands(commands)
+	}
+
+	if promMetrics != nil {
+		startMetrics(*metricsAddr)
+	}
+
+	var ui *dashboard
+	if *httpUI != "" {
+		ui = &dashboard{
+			profile: target != nil,
+			setRate: func(rps float64) {
+				rate.Set(rps, time.Second)
+			},
+			stop: stopRun,
+		}
+
+		startDashboard(*httpUI, ui)
+	}
 
 	// Start ticking here so we won't have more than rps
 	// requests after the first tick.
 	secondTicker := time.Tick(time.Second)
 	startTime := time.Now()
+	warmupEnd = startTime.Add(*warmup)
+	maxRequests = *requests
+
+	if *runDuration > 0 {
+		time.AfterFunc(*warmup+*runDuration, stopRun)
+	}
+
+	if replay != nil && replay.timed != nil {
+		go replay.dispatch(startTime)
+	} else if *openloop {
+		schedule = make(chan time.Time, *workers)
+		go dispatch(startTime)
+	}
+
+	if target != nil {
+		go runProfile(target, startTime)
+	}
 
 	start.Done()
 
 	// Now all workers are firing request and we can start collecting durations.
 
-	durations := make(Durations, 0)
-	durationsN := uint64(0)
+	st := newStats(*precision)
+	collected := make(chan struct{}, 0)
 
 	go func() {
-		for {
-			select {
-			case duration := <-durationChan:
-				durations = append(durations, duration)
-				atomic.AddUint64(&durationsN, 1)
-			case <-stop:
-				for range durationChan {
-					// Do nothing, just consume so the workers don't hang.
-				}
+		for r := range resultChan {
+			st.record(r)
+
+			if promMetrics != nil {
+				promMetrics.record(r)
 			}
 		}
+
+		close(collected)
 	}()
 
 	// While collecting durations we should notify the user every second.
 
-	lastDurationsN := uint64(0)
-	lastErrorsN := uint64(0)
+	samples := make([]sample, 0)
+
+	lastLateN := uint64(0)
+	lastDroppedN := uint64(0)
+	lastServerClosedN := uint64(0)
+
+	// Late and dropped requests and server closes during the warm-up are
+	// subtracted from the totals.
+	warmupDone := time.After(*warmup)
+	warmupLateN := uint64(0)
+	warmupDroppedN := uint64(0)
+	warmupServerClosedN := uint64(0)
 
 	// Wait for Ctrl+C to stop.
 	c := make(chan os.Signal, 0)
@@ -350,49 +959,99 @@ printFor:
 			break printFor
 		case <-stop:
 			break printFor
+		case <-warmupDone:
+			warmupLateN = atomic.LoadUint64(&lateN)
+			warmupDroppedN = atomic.LoadUint64(&droppedN)
+			warmupServerClosedN = atomic.LoadUint64(&serverClosedN)
+			warmupDone = nil
 		case <-secondTicker:
-			nowDurationsN := atomic.LoadUint64(&durationsN)
-			nowErrorsN := atomic.LoadUint64(&errorsN)
+			now := time.Now()
+			nowLateN := atomic.LoadUint64(&lateN)
+			nowDroppedN := atomic.LoadUint64(&droppedN)
+			nowServerClosedN := atomic.LoadUint64(&serverClosedN)
+			second, latencies := st.takeSecond()
+
+			sm := sample{
+				Elapsed:      float64(now.Sub(startTime) / time.Second),
+				Warmup:       now.Add(-time.Second).Before(warmupEnd),
+				Requests:     second.requests,
+				Errors:       second.errors,
+				Status:       statusCounts(second.status),
+				ErrorClasses: second.errorClasses,
+				Late:         nowLateN - lastLateN,
+				Dropped:      nowDroppedN - lastDroppedN,
+				NewConns:     second.newConns,
+				ReusedConns:  second.reusedConns,
+				ServerClosed: nowServerClosedN - lastServerClosedN,
+				UploadBytes:  second.uploadBytes,
+				Target:       rate.Rate(),
+				Latency:      newLatency(latencies, percentiles),
+			}
+
+			if stream != nil {
+				counts := latencies.Counts()
+				sendRecord(agentRecord{Sample: &sm, Latencies: &counts})
+			} else {
+				sm.print(*openloop, target != nil)
+			}
+			samples = append(samples, sm)
 
-			// Always format the time elapsed as exactly 6 characters.
-			s := "      " + ((time.Now().Sub(startTime) / time.Second) * time.Second).String()
-			fmt.Printf("%s: %d requests %d errors\n", s[len(s)-6:], nowDurationsN-lastDurationsN, nowErrorsN-lastErrorsN)
+			if ui != nil {
+				ui.add(sm)
+			}
 
-			lastDurationsN = nowDurationsN
-			lastErrorsN = nowErrorsN
+			if promMetrics != nil {
+				promMetrics.setAchieved(float64(second.total))
+			}
+
+			lastLateN = nowLateN
+			lastDroppedN = nowDroppedN
+			lastServerClosedN = nowServerClosedN
 		}
 	}
 
 	stopTime := time.Now()
 
-	// Stop all workers.
-	// This might fail if one of the workers also closes the stop channel.
-	// To prevent a panic we wrapt this close in a recover.
-	func() {
-		defer func() {
-			recover()
-		}()
+	stopRun()
 
-		close(stop)
-	}()
+	if ui != nil {
+		ui.finish()
+	}
 
 	// Wait until all workers are done.
 	workersWg.Wait()
 
-	duration := time.Duration(stopTime.Sub(startTime)/time.Millisecond) * time.Millisecond
-	perSecond := float64(durationsN) / (float64(duration) / float64(time.Second))
+	close(resultChan)
+	<-collected
 
-	sort.Sort(durations)
+	if stopTime.Before(warmupEnd) {
+		stopTime = warmupEnd
+	} else if warmupDone != nil {
+		// Stopped right after the warm-up ended.
+		warmupLateN = atomic.LoadUint64(&lateN)
+		warmupDroppedN = atomic.LoadUint64(&droppedN)
+		warmupServerClosedN = atomic.LoadUint64(&serverClosedN)
+	}
 
-	fmt.Printf("\n%d successful requests in %v\n", durationsN, duration)
-	fmt.Printf("%d error(s)\n", atomic.LoadUint64(&errorsN))
-	fmt.Printf("successful requests/sec: %.2f\n", perSecond)
-	if durationsN > 0 {
-		fmt.Printf("latency distribution:\n")
-		fmt.Printf("   50%% %v\n", durations[int(float64(durationsN)*0.50)])
-		fmt.Printf("   75%% %v\n", durations[int(float64(durationsN)*0.75)])
-		fmt.Printf("   90%% %v\n", durations[int(float64(durationsN)*0.90)])
-		fmt.Printf("   99%% %v\n", durations[int(float64(durationsN)*0.99)])
-		fmt.Printf("  100%% %v\n", durations[durationsN-1])
+	duration := time.Duration(stopTime.Sub(startTime.Add(*warmup))/time.Millisecond) * time.Millisecond
+	late := atomic.LoadUint64(&lateN) - warmupLateN
+	dropped := atomic.LoadUint64(&droppedN) - warmupDroppedN
+	serverClosed := atomic.LoadUint64(&serverClosedN) - warmupServerClosedN
+
+	// The coordinator merges the statistics and reports them.
+	if stream != nil {
+		a := newAgentStats(st)
+		a.Duration = duration.Seconds()
+		a.Late = late
+		a.Dropped = dropped
+		a.ServerClosed = serverClosed
+
+		sendRecord(agentRecord{Stats: a})
+		return
 	}
+
+	sum := newSummary(st, duration, *openloop, late, dropped, serverClosed, percentiles)
+	sum.Samples = samples
+
+	finish(&sum, st, thresholds, *output)
 }
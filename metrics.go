@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The buckets of the histograms in seconds.
+var (
+	latencyBuckets  = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	callbackBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .1}
+)
+
+var (
+	inFlightN = int64(0)
+	workersN  = int64(0)
+)
+
+// promMetrics contains the metrics for Prometheus. It is nil when -metrics
+// isn't used.
+var promMetrics *metrics
+
+type statusLabels struct {
+	status string
+	tag    string
+}
+
+type errorLabels struct {
+	class string
+	tag   string
+}
+
+// metrics contains the metrics of the whole run, including the warm-up.
+type metrics struct {
+	m sync.Mutex
+
+	requests  map[statusLabels]uint64
+	errors    map[errorLabels]uint64
+	latencies map[string]*promHistogram // By tag.
+	callbacks map[string]*promHistogram // By Lua callback.
+	tags      map[string]bool           // Like the statistics at most maxTags.
+	achieved  float64                   // Requests in the last second.
+	uploaded  uint64                    // Bytes of request bodies sent.
+}
+
+// promHistogram is a histogram with fixed buckets like Prometheus uses.
+type promHistogram struct {
+	buckets []float64
+	counts  []uint64 // Not cumulative, the last one is for +Inf.
+	sum     float64
+	count   uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  make(map[statusLabels]uint64, 0),
+		errors:    make(map[errorLabels]uint64, 0),
+		latencies: make(map[string]*promHistogram, 0),
+		callbacks: make(map[string]*promHistogram, 0),
+		tags:      make(map[string]bool, 0),
+	}
+}
+
+func newPromHistogram(buckets []float64) *promHistogram {
+	return &promHistogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *promHistogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.buckets, v)]++
+	h.sum += v
+	h.count++
+}
+
+// record adds a result.
+func (m *metrics) record(r result) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.uploaded += r.uploadBytes
+
+	tag := m.tag(r.tag)
+
+	if r.response {
+		m.requests[statusLabels{strconv.Itoa(r.status), tag}]++
+
+		h, ok := m.latencies[tag]
+		if !ok {
+			h = newPromHistogram(latencyBuckets)
+			m.latencies[tag] = h
+		}
+
+		h.observe(r.latency.Seconds())
+	}
+
+	if r.failed {
+		m.errors[errorLabels{r.errorClass, tag}]++
+	}
+}
+
+// tag returns the label for a tag. Like the statistics only maxTags tags
+// are tracked so tags like ids don't create unlimited series.
+func (m *metrics) tag(tag string) string {
+	if m.tags[tag] {
+		return tag
+	}
+
+	if len(m.tags) >= maxTags {
+		tag = otherTag
+	}
+
+	m.tags[tag] = true
+
+	return tag
+}
+
+// setAchieved sets the number of requests of the last second.
+func (m *metrics) setAchieved(rps float64) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.achieved = rps
+}
+
+// observeCallback records how long a call to a Lua callback took.
+func observeCallback(callback string, d time.Duration) {
+	m := promMetrics
+	if m == nil {
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	h, ok := m.callbacks[callback]
+	if !ok {
+		h = newPromHistogram(callbackBuckets)
+		m.callbacks[callback] = h
+	}
+
+	h.observe(d.Seconds())
+}
+
+// labelValue escapes a label value for the text format.
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeHistogram writes h with labels, which is empty or ends with a comma.
+func writeHistogram(w io.Writer, name, labels string, h *promHistogram) {
+	cumulative := uint64(0)
+
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(le), cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func sortedHistograms(hs map[string]*promHistogram) []string {
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	writeHeader(w, "hench_requests_total", "counter", "Requests that got a response by status code and tag.")
+	statuses := make([]statusLabels, 0, len(m.requests))
+	for l := range m.requests {
+		statuses = append(statuses, l)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].tag != statuses[j].tag {
+			return statuses[i].tag < statuses[j].tag
+		}
+		return statuses[i].status < statuses[j].status
+	})
+	for _, l := range statuses {
+		fmt.Fprintf(w, "hench_requests_total{status=\"%s\",tag=\"%s\"} %d\n", l.status, labelValue(l.tag), m.requests[l])
+	}
+
+	writeHeader(w, "hench_errors_total", "counter", "Failed requests by error class and tag.")
+	errors := make([]errorLabels, 0, len(m.errors))
+	for l := range m.errors {
+		errors = append(errors, l)
+	}
+	sort.Slice(errors, func(i, j int) bool {
+		if errors[i].tag != errors[j].tag {
+			return errors[i].tag < errors[j].tag
+		}
+		return errors[i].class < errors[j].class
+	})
+	for _, l := range errors {
+		fmt.Fprintf(w, "hench_errors_total{class=\"%s\",tag=\"%s\"} %d\n", labelValue(l.class), labelValue(l.tag), m.errors[l])
+	}
+
+	writeHeader(w, "hench_request_duration_seconds", "histogram", "Latency of the requests that got a response by tag.")
+	for _, tag := range sortedHistograms(m.latencies) {
+		writeHistogram(w, "hench_request_duration_seconds", "tag=\""+labelValue(tag)+"\",", m.latencies[tag])
+	}
+
+	writeHeader(w, "hench_upload_bytes_total", "counter", "Bytes of request bodies that were sent.")
+	fmt.Fprintf(w, "hench_upload_bytes_total %d\n", m.uploaded)
+
+	writeHeader(w, "hench_in_flight_requests", "gauge", "Requests that are being performed.")
+	fmt.Fprintf(w, "hench_in_flight_requests %d\n", atomic.LoadInt64(&inFlightN))
+
+	writeHeader(w, "hench_workers", "gauge", "Workers that are running.")
+	fmt.Fprintf(w, "hench_workers %d\n", atomic.LoadInt64(&workersN))
+
+	writeHeader(w, "hench_target_rps", "gauge", "The target number of requests per second.")
+	fmt.Fprintf(w, "hench_target_rps %s\n", formatFloat(rate.Rate()))
+
+	writeHeader(w, "hench_achieved_rps", "gauge", "The number of requests finished in the last second.")
+	fmt.Fprintf(w, "hench_achieved_rps %s\n", formatFloat(m.achieved))
+
+	writeHeader(w, "hench_lua_callback_duration_seconds", "histogram", "Time spent in the Lua callbacks by callback.")
+	for _, callback := range sortedHistograms(m.callbacks) {
+		writeHistogram(w, "hench_lua_callback_duration_seconds", "callback=\""+callback+"\",", m.callbacks[callback])
+	}
+}
+
+// startMetrics serves promMetrics on addr. The rate limiter has to be created
+// before.
+func startMetrics(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		b := bufio.NewWriter(w)
+		promMetrics.write(b)
+		b.Flush()
+	})
+
+	fmt.Printf("metrics available on http://%s/metrics\n", l.Addr())
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Print(err)
+		}
+	}()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/erikdubbelboer/hench/internal/profile"
+	"github.com/yuin/gopher-lua"
+)
+
+// How often the target rate of a load profile is updated.
+const profileInterval = 100 * time.Millisecond
+
+// targetFunc returns the target rate `elapsed` after the start of the run.
+// It returns false when the run should stop.
+type targetFunc func(elapsed time.Duration) (float64, bool)
+
+// loadProfile returns the load profile to use. Stages passed using -profile
+// take precedence over the profile defined by the script. It returns nil
+// when there is no load profile.
+func loadProfile(stages string, start float64, ls *luaState) (targetFunc, string, error) {
+	if stages != "" {
+		s, err := profile.Parse(stages)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return profileTarget(start, s)
+	}
+
+	ls.Lock()
+	defer ls.Unlock()
+
+	switch p := ls.L.GetGlobal("profile").(type) {
+	case lua.LString:
+		s, err := profile.Parse(string(p))
+		if err != nil {
+			return nil, "", err
+		}
+
+		return profileTarget(start, s)
+	case *lua.LTable:
+		s, err := luaStages(p)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return profileTarget(start, s)
+	case *lua.LFunction:
+		return luaTarget(ls, p), "lua profile function", nil
+	case *lua.LNilType:
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("profile should be a string, table or function not a %s", p.Type())
+	}
+}
+
+func profileTarget(start float64, stages []profile.Stage) (targetFunc, string, error) {
+	if len(stages) == 0 {
+		return nil, "", nil
+	}
+
+	p := profile.New(start, stages)
+	description := ""
+
+	for i, s := range stages {
+		if i > 0 {
+			description += ","
+		}
+
+		description += s.String()
+	}
+
+	return p.Rate, description, nil
+}
+
+// luaStages converts a Lua table of stages to a slice of stages.
+// Each stage is either a string as accepted by -profile or a table:
+//
+//	{ stage = 'ramp', rps = 500, duration = '60s' }
+//
+// Durations can be strings or numbers of seconds.
+func luaStages(table *lua.LTable) ([]profile.Stage, error) {
+	stages := make([]profile.Stage, 0, table.Len())
+
+	for i := 1; i <= table.Len(); i++ {
+		switch v := table.RawGetInt(i).(type) {
+		case lua.LString:
+			s, err := profile.Parse(string(v))
+			if err != nil {
+				return nil, err
+			}
+
+			stages = append(stages, s...)
+		case *lua.LTable:
+			s := profile.Stage{
+				Kind: lua.LVAsString(v.RawGetString("stage")),
+			}
+
+			if rps, ok := v.RawGetString("rps").(lua.LNumber); ok {
+				s.Rate = float64(rps)
+			}
+
+			switch d := v.RawGetString("duration").(type) {
+			case lua.LNumber:
+				s.Duration = time.Duration(float64(d) * float64(time.Second))
+			case lua.LString:
+				var err error
+				if s.Duration, err = time.ParseDuration(string(d)); err != nil {
+					return nil, fmt.Errorf("invalid duration in stage %d: %s", i, d)
+				}
+			}
+
+			if err := s.Validate(); err != nil {
+				return nil, err
+			}
+
+			stages = append(stages, s)
+		default:
+			return nil, fmt.Errorf("invalid stage %d: %s", i, v.String())
+		}
+	}
+
+	return stages, nil
+}
+
+// luaTarget calls the Lua profile function with the number of seconds elapsed.
+// The function should return the target rate or nil to stop.
+func luaTarget(ls *luaState, fn *lua.LFunction) targetFunc {
+	return func(elapsed time.Duration) (float64, bool) {
+		ls.Lock()
+		defer ls.Unlock()
+
+		L := ls.L
+
+		called := time.Now()
+		if err := L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    1,
+			Protect: true,
+		}, lua.LNumber(elapsed.Seconds())); err != nil {
+			log.Fatal(err)
+		}
+		observeCallback("profile", time.Since(called))
+
+		ret := L.Get(-1)
+		L.Pop(1)
+
+		if n, ok := ret.(lua.LNumber); ok {
+			return float64(n), true
+		}
+
+		return 0, false
+	}
+}
+
+// runProfile updates the rate limiter according to the load profile and
+// stops the run when the profile is done.
+func runProfile(target targetFunc, startTime time.Time) {
+	ticker := time.NewTicker(profileInterval)
+	defer ticker.Stop()
+
+	for {
+		r, ok := target(time.Now().Sub(startTime))
+		if !ok {
+			stopRun()
+			return
+		}
+
+		rate.Set(r*rateShare, time.Second)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The script used with -replay without -script. The requests come from the
+// replay so only the response has to be checked.
+const replayScript = `
+	function response(res, state)
+		return res.status < 400
+	end
+`
+
+// The replay when -replay is used.
+var replay *replayer
+
+// replayEntry is a recorded request.
+type replayEntry struct {
+	at     time.Time // Zero when unknown.
+	offset time.Duration
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// timedEntry is an entry scheduled to start at intended.
+type timedEntry struct {
+	entry    *replayEntry
+	intended time.Time
+}
+
+// replayer hands out the recorded requests to the workers.
+type replayer struct {
+	entries []replayEntry
+	loop    bool
+
+	// The lines of the file that were skipped because they aren't requests.
+	skipped int
+
+	// With a speed the requests are replayed with their original timing, a
+	// speed of 2 replays twice as fast. Without a speed they are replayed as
+	// fast as the rate limiter allows.
+	speed float64
+	timed chan timedEntry
+
+	next     uint64
+	finished uint64
+}
+
+// Headers that are set by the client or would point the request to the
+// recorded host instead of the url.
+var replaySkipHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+}
+
+// errNotRequest is returned for lines that aren't a JSON record or an access
+// log line of a request. Access logs can contain lines like these for
+// invalid requests, they are skipped.
+var errNotRequest = errors.New("not a HAR file, JSON record or access log line")
+
+// The common and combined log formats, the referer and user agent are optional.
+var accessLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)(?: [^"]*)?" \S+ \S+(?: "([^"]*)" "([^"]*)")?`)
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type jsonlRecord struct {
+	Time    time.Time         `json:"time"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// loadReplay reads the requests to replay from a HAR file, JSON lines or an
+// access log. Urls are resolved against base, and when base is set the
+// requests are sent to its host instead of the recorded host.
+func loadReplay(name, base string, speed float64, loop bool) (*replayer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseURL *url.URL
+	if base != "" {
+		if baseURL, err = url.Parse(base); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []replayEntry
+	skipped := 0
+
+	var har harFile
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) && json.Unmarshal(data, &har) == nil && har.Log.Entries != nil {
+		entries = make([]replayEntry, 0, len(har.Log.Entries))
+
+		for _, e := range har.Log.Entries {
+			entry := replayEntry{
+				at:     e.StartedDateTime,
+				method: e.Request.Method,
+				url:    e.Request.URL,
+				header: make(http.Header, 0),
+			}
+
+			for _, h := range e.Request.Headers {
+				// HTTP/2 pseudo headers like :authority.
+				if !strings.HasPrefix(h.Name, ":") {
+					entry.header.Add(h.Name, h.Value)
+				}
+			}
+
+			if e.Request.PostData != nil {
+				entry.body = []byte(e.Request.PostData.Text)
+			}
+
+			entries = append(entries, entry)
+		}
+	} else {
+		entries = make([]replayEntry, 0)
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			entry, err := parseReplayLine(line)
+			if err == errNotRequest {
+				skipped++
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no requests to replay in %s", name)
+	}
+
+	for i := range entries {
+		e := &entries[i]
+
+		if e.method == "" {
+			e.method = "GET"
+		}
+
+		if e.url, err = replayURL(e.url, baseURL); err != nil {
+			return nil, err
+		}
+
+		for h := range replaySkipHeaders {
+			e.header.Del(h)
+		}
+	}
+
+	// Entries are replayed in the order they were recorded.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	for i := range entries {
+		if !entries[i].at.IsZero() && !entries[0].at.IsZero() {
+			entries[i].offset = entries[i].at.Sub(entries[0].at)
+		}
+	}
+
+	if speed > 0 && entries[len(entries)-1].offset == 0 {
+		return nil, fmt.Errorf("the requests in %s have no times to replay them with", name)
+	}
+
+	r := &replayer{
+		entries: entries,
+		loop:    loop,
+		skipped: skipped,
+		speed:   speed,
+	}
+
+	if speed > 0 {
+		r.timed = make(chan timedEntry, 0)
+	}
+
+	return r, nil
+}
+
+// parseReplayLine parses a JSON record or an access log line.
+func parseReplayLine(line string) (replayEntry, error) {
+	if strings.HasPrefix(line, "{") {
+		var record jsonlRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return replayEntry{}, err
+		}
+
+		entry := replayEntry{
+			at:     record.Time,
+			method: record.Method,
+			url:    record.URL,
+			header: make(http.Header, len(record.Headers)),
+			body:   []byte(record.Body),
+		}
+
+		for name, value := range record.Headers {
+			entry.header.Set(name, value)
+		}
+
+		return entry, nil
+	}
+
+	m := accessLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return replayEntry{}, errNotRequest
+	}
+
+	at, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[1])
+	if err != nil {
+		return replayEntry{}, errNotRequest
+	}
+
+	entry := replayEntry{
+		at:     at,
+		method: m[2],
+		url:    m[3],
+		header: make(http.Header, 0),
+	}
+
+	if m[4] != "" && m[4] != "-" {
+		entry.header.Set("Referer", m[4])
+	}
+	if m[5] != "" && m[5] != "-" {
+		entry.header.Set("User-Agent", m[5])
+	}
+
+	return entry, nil
+}
+
+// replayURL resolves the recorded url against base.
+func replayURL(recorded string, base *url.URL) (string, error) {
+	u, err := url.Parse(recorded)
+	if err != nil {
+		return "", err
+	}
+
+	if base == nil {
+		if !u.IsAbs() {
+			return "", fmt.Errorf("a url is needed to replay %s", recorded)
+		}
+
+		return u.String(), nil
+	}
+
+	u.Scheme = base.Scheme
+	u.Host = base.Host
+	u.User = base.User
+
+	// A base with a path is a prefix for all recorded paths.
+	if p := strings.TrimSuffix(base.Path, "/"); p != "" {
+		u.Path = p + u.Path
+		u.RawPath = ""
+	}
+
+	return u.String(), nil
+}
+
+// request returns the request for an entry.
+func (e *replayEntry) request() *request {
+	var body io.Reader
+	if len(e.body) > 0 {
+		body = bytes.NewReader(e.body)
+	}
+
+	req, err := http.NewRequest(e.method, e.url, body)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for name, values := range e.header {
+		req.Header[name] = values
+	}
+
+	return &request{
+		Request: req,
+		timeout: defaultTimeout,
+		tag:     defaultTag(req.Method, req.URL),
+	}
+}
+
+// take returns the next entry or false when all entries have been taken.
+func (r *replayer) take() (*replayEntry, bool) {
+	i := atomic.AddUint64(&r.next, 1) - 1
+
+	if i >= uint64(len(r.entries)) && !r.loop {
+		return nil, false
+	}
+
+	return &r.entries[i%uint64(len(r.entries))], true
+}
+
+// finish is called for every entry that is done or dropped, the run stops
+// after all entries are done unless the replay loops.
+func (r *replayer) finish() {
+	if atomic.AddUint64(&r.finished, 1) == uint64(len(r.entries)) && !r.loop {
+		stopRun()
+	}
+}
+
+// wait blocks until the worker can perform the next request like waitTurn.
+func (r *replayer) wait() (*request, time.Time, bool) {
+	if r.timed != nil {
+		select {
+		case <-stop:
+			return nil, time.Time{}, false
+		case <-finishing:
+			return nil, time.Time{}, false
+		case t := <-r.timed:
+			return t.entry.request(), t.intended, true
+		}
+	}
+
+	intended, ok := waitTurn()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	e, ok := r.take()
+	if !ok {
+		// Wait for the last requests to finish.
+		<-stop
+		return nil, time.Time{}, false
+	}
+
+	return e.request(), intended, true
+}
+
+// dispatch schedules the entries with their original timing starting at
+// start. Like the open-loop model requests are dropped when all workers are
+// busy.
+func (r *replayer) dispatch(start time.Time) {
+	for {
+		var last time.Duration
+
+		for i := range r.entries {
+			e := &r.entries[i]
+			last = time.Duration(float64(e.offset) / r.speed)
+			intended := start.Add(last)
+
+			if wait := intended.Sub(time.Now()); wait > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(wait):
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			case r.timed <- timedEntry{entry: e, intended: intended}:
+			default:
+				atomic.AddUint64(&droppedN, 1)
+				r.finish()
+			}
+		}
+
+		if !r.loop {
+			return
+		}
+
+		// The time between the last and the first entry isn't known so the
+		// average time between entries is used.
+		start = start.Add(last + last/time.Duration(len(r.entries)-1))
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erikdubbelboer/hench/internal/histogram"
+)
+
+// All latencies in the reports are in milliseconds.
+
+type percentile struct {
+	Percentile float64 `json:"percentile"`
+	Latency    float64 `json:"latency"`
+}
+
+type latency struct {
+	Min         float64      `json:"min"`
+	Mean        float64      `json:"mean"`
+	Max         float64      `json:"max"`
+	Percentiles []percentile `json:"percentiles"`
+}
+
+// phaseLatency is the latency distribution of one phase of the requests.
+type phaseLatency struct {
+	Phase   string  `json:"phase"`
+	Count   int64   `json:"count"`
+	Latency latency `json:"latency"`
+}
+
+// connectionSummary contains how many connections were opened, reused and
+// closed by the server and how long reused connections were idle.
+type connectionSummary struct {
+	New          uint64  `json:"new"`
+	Reused       uint64  `json:"reused"`
+	ServerClosed uint64  `json:"server_closed"`
+	IdleTime     latency `json:"idle_time"`
+}
+
+// uploadSummary contains how many bytes of request bodies were sent and
+// the throughput while they were sent.
+type uploadSummary struct {
+	Bytes          uint64  `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// groupSummary contains the statistics of a group of requests.
+type groupSummary struct {
+	Requests          uint64  `json:"requests"`
+	Errors            uint64  `json:"errors"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Latency           latency `json:"latency"`
+}
+
+// tagSummary contains the statistics of all requests with the same tag.
+type tagSummary struct {
+	Tag string `json:"tag"`
+	groupSummary
+}
+
+// remoteSummary contains the statistics of all requests to the same IP.
+type remoteSummary struct {
+	Remote string `json:"remote"`
+	groupSummary
+}
+
+// sample contains the statistics of a single second.
+type sample struct {
+	Elapsed      float64           `json:"elapsed"`
+	Warmup       bool              `json:"warmup"`
+	Requests     uint64            `json:"requests"`
+	Errors       uint64            `json:"errors"`
+	Status       map[string]uint64 `json:"status"`
+	ErrorClasses map[string]uint64 `json:"error_classes"`
+	Late         uint64            `json:"late"`
+	Dropped      uint64            `json:"dropped"`
+	NewConns     uint64            `json:"new_conns"`
+	ReusedConns  uint64            `json:"reused_conns"`
+	ServerClosed uint64            `json:"server_closed"`
+	UploadBytes  uint64            `json:"upload_bytes"`
+	Target       float64           `json:"target"`
+	Latency      latency           `json:"latency"`
+}
+
+type summary struct {
+	Duration          float64           `json:"duration"`
+	Requests          uint64            `json:"requests"`
+	Errors            uint64            `json:"errors"`
+	Status            map[string]uint64 `json:"status"`
+	Protocols         map[string]uint64 `json:"protocols"`
+	TLSHandshakes     uint64            `json:"tls_handshakes"`
+	TLSResumed        uint64            `json:"tls_resumed"`
+	QUICHandshakes    uint64            `json:"quic_handshakes"`
+	ZeroRTT           uint64            `json:"zero_rtt"`
+	ErrorClasses      map[string]uint64 `json:"error_classes"`
+	RequestsPerSecond float64           `json:"requests_per_second"`
+	OpenLoop          bool              `json:"openloop"`
+	Late              uint64            `json:"late"`
+	Dropped           uint64            `json:"dropped"`
+	Latency           latency           `json:"latency"`
+	Phases            []phaseLatency    `json:"phases"`
+	Connections       connectionSummary `json:"connections"`
+	Upload            uploadSummary     `json:"upload"`
+	Tags              []tagSummary      `json:"tags"`
+	Remotes           []remoteSummary   `json:"remotes"`
+	Thresholds        []thresholdResult `json:"thresholds"`
+	Samples           []sample          `json:"samples"`
+}
+
+func milliseconds(d int64) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func fromMilliseconds(ms float64) time.Duration {
+	return time.Duration(math.Floor(ms*float64(time.Millisecond) + 0.5))
+}
+
+func newLatency(h *histogram.Histogram, percentiles []float64) latency {
+	l := latency{
+		Min:         milliseconds(h.Min()),
+		Mean:        h.Mean() / float64(time.Millisecond),
+		Max:         milliseconds(h.Max()),
+		Percentiles: make([]percentile, 0, len(percentiles)),
+	}
+
+	for _, p := range percentiles {
+		l.Percentiles = append(l.Percentiles, percentile{
+			Percentile: p,
+			Latency:    milliseconds(h.Quantile(p / 100)),
+		})
+	}
+
+	return l
+}
+
+func newPhaseLatencies(hs [numPhases]*histogram.Histogram, percentiles []float64) []phaseLatency {
+	p := make([]phaseLatency, 0, numPhases)
+
+	for i, h := range hs {
+		p = append(p, phaseLatency{
+			Phase:   phaseNames[i],
+			Count:   h.Count(),
+			Latency: newLatency(h, percentiles),
+		})
+	}
+
+	return p
+}
+
+func newGroupSummary(t *tagStats, duration time.Duration, percentiles []float64) groupSummary {
+	perSecond := float64(0)
+	if duration > 0 {
+		perSecond = float64(t.requests) / duration.Seconds()
+	}
+
+	return groupSummary{
+		Requests:          t.requests,
+		Errors:            t.errors,
+		RequestsPerSecond: perSecond,
+		Latency:           newLatency(t.latencies, percentiles),
+	}
+}
+
+func newTagSummaries(tags map[string]*tagStats, duration time.Duration, percentiles []float64) []tagSummary {
+	summaries := make([]tagSummary, 0, len(tags))
+
+	for tag, t := range tags {
+		summaries = append(summaries, tagSummary{
+			Tag:          tag,
+			groupSummary: newGroupSummary(t, duration, percentiles),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Tag < summaries[j].Tag
+	})
+
+	return summaries
+}
+
+func newRemoteSummaries(remotes map[string]*tagStats, duration time.Duration, percentiles []float64) []remoteSummary {
+	summaries := make([]remoteSummary, 0, len(remotes))
+
+	for remote, t := range remotes {
+		summaries = append(summaries, remoteSummary{
+			Remote:       remote,
+			groupSummary: newGroupSummary(t, duration, percentiles),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Remote < summaries[j].Remote
+	})
+
+	return summaries
+}
+
+// newSummary returns the summary of a run without the samples.
+func newSummary(st *stats, duration time.Duration, openloop bool, late, dropped, serverClosed uint64, percentiles []float64) summary {
+	perSecond := float64(0)
+	if duration > 0 {
+		perSecond = float64(st.requests) / duration.Seconds()
+	}
+
+	// The upload throughput is measured over the time spent uploading and
+	// not over the duration of the run.
+	uploadPerSecond := float64(0)
+	if st.uploadTime > 0 {
+		uploadPerSecond = float64(st.uploadBytes) / st.uploadTime.Seconds()
+	}
+
+	return summary{
+		Duration:          duration.Seconds(),
+		Requests:          st.requests,
+		Errors:            st.errors,
+		Status:            statusCounts(st.status),
+		Protocols:         st.protos,
+		TLSHandshakes:     st.tlsHandshakes,
+		TLSResumed:        st.tlsResumed,
+		QUICHandshakes:    st.quicHandshakes,
+		ZeroRTT:           st.zeroRTT,
+		ErrorClasses:      st.errorClasses,
+		RequestsPerSecond: perSecond,
+		OpenLoop:          openloop,
+		Late:              late,
+		Dropped:           dropped,
+		Latency:           newLatency(st.latencies, percentiles),
+		Phases:            newPhaseLatencies(st.phases, percentiles),
+		Connections: connectionSummary{
+			New:          st.newConns,
+			Reused:       st.reusedConns,
+			ServerClosed: serverClosed,
+			IdleTime:     newLatency(st.idleTimes, percentiles),
+		},
+		Upload: uploadSummary{
+			Bytes:          st.uploadBytes,
+			BytesPerSecond: uploadPerSecond,
+		},
+		Tags:    newTagSummaries(st.tags, duration, percentiles),
+		Remotes: newRemoteSummaries(st.remotes, duration, percentiles),
+	}
+}
+
+// statusCounts converts the status codes to strings so they can be used as
+// keys in JSON.
+func statusCounts(status map[int]uint64) map[string]uint64 {
+	counts := make(map[string]uint64, len(status))
+
+	for code, n := range status {
+		counts[strconv.Itoa(code)] = n
+	}
+
+	return counts
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatPercentile(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// formatBytes formats a number of bytes using binary units.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+
+	return fmt.Sprintf("%.2f %s", n, units[i])
+}
+
+// formatElapsed always formats the time elapsed as exactly 6 characters.
+func formatElapsed(elapsed float64) string {
+	s := "      " + (time.Duration(elapsed) * time.Second).String()
+	return s[len(s)-6:]
+}
+
+func (s *sample) print(openloop, profile bool) {
+	fmt.Printf("%s: %d requests %d errors", formatElapsed(s.Elapsed), s.Requests, s.Errors)
+
+	// Only show the status codes and error classes when something is wrong.
+	breakdown := make([]string, 0)
+	for _, code := range sortedKeys(s.Status) {
+		if code[0] != '2' {
+			breakdown = append(breakdown, fmt.Sprintf("%s: %d", code, s.Status[code]))
+		}
+	}
+	for _, class := range sortedKeys(s.ErrorClasses) {
+		breakdown = append(breakdown, fmt.Sprintf("%s: %d", class, s.ErrorClasses[class]))
+	}
+	if len(breakdown) > 0 {
+		fmt.Printf(" (%s)", strings.Join(breakdown, ", "))
+	}
+
+	fmt.Printf(" %d new %d reused conns", s.NewConns, s.ReusedConns)
+	if s.ServerClosed > 0 {
+		fmt.Printf(" %d closed by server", s.ServerClosed)
+	}
+
+	if s.UploadBytes > 0 {
+		fmt.Printf(" %s/s uploaded", formatBytes(float64(s.UploadBytes)))
+	}
+
+	if profile {
+		fmt.Printf(" %.0f target rps", s.Target)
+	}
+
+	if openloop {
+		fmt.Printf(" %d late %d dropped", s.Late, s.Dropped)
+	}
+
+	if s.Warmup {
+		fmt.Printf(" (warmup)")
+	}
+
+	fmt.Printf("\n")
+}
+
+func (s *summary) print() {
+	duration := time.Duration(s.Duration*1000) * time.Millisecond
+
+	fmt.Printf("\n%d successful requests in %v\n", s.Requests, duration)
+	fmt.Printf("%d error(s)\n", s.Errors)
+	if len(s.Status) > 0 {
+		fmt.Printf("status codes:\n")
+		for _, code := range sortedKeys(s.Status) {
+			fmt.Printf("  %8s %d\n", code, s.Status[code])
+		}
+	}
+	if len(s.Protocols) > 0 {
+		fmt.Printf("protocols:\n")
+		for _, proto := range sortedKeys(s.Protocols) {
+			fmt.Printf("  %8s %d\n", proto, s.Protocols[proto])
+		}
+	}
+	fmt.Printf("%d new connection(s), %d reused, %d closed by server\n",
+		s.Connections.New, s.Connections.Reused, s.Connections.ServerClosed)
+	if s.TLSHandshakes > 0 {
+		fmt.Printf("%d TLS handshake(s), %d resumed (%.2f%%)\n",
+			s.TLSHandshakes, s.TLSResumed, float64(s.TLSResumed)/float64(s.TLSHandshakes)*100)
+	}
+	if s.QUICHandshakes > 0 {
+		fmt.Printf("%d QUIC handshake(s), %d using 0-RTT (%.2f%%)\n",
+			s.QUICHandshakes, s.ZeroRTT, float64(s.ZeroRTT)/float64(s.QUICHandshakes)*100)
+	}
+	if len(s.ErrorClasses) > 0 {
+		fmt.Printf("errors:\n")
+		for _, class := range sortedKeys(s.ErrorClasses) {
+			fmt.Printf("  %8s %d\n", class, s.ErrorClasses[class])
+		}
+	}
+	fmt.Printf("successful requests/sec: %.2f\n", s.RequestsPerSecond)
+	if s.Upload.Bytes > 0 {
+		fmt.Printf("uploaded %s (%s/s while uploading)\n", formatBytes(float64(s.Upload.Bytes)), formatBytes(s.Upload.BytesPerSecond))
+	}
+	if s.OpenLoop {
+		fmt.Printf("%d late request(s)\n", s.Late)
+		fmt.Printf("%d dropped request(s)\n", s.Dropped)
+	}
+	if s.Requests > 0 {
+		fmt.Printf("latency distribution:\n")
+		for _, p := range s.Latency.Percentiles {
+			fmt.Printf("%6s %v\n", formatPercentile(p.Percentile)+"%", fromMilliseconds(p.Latency))
+		}
+
+		fmt.Printf("phase distribution:\n")
+		fmt.Printf("%8s %8s", "", "count")
+		for _, p := range s.Latency.Percentiles {
+			fmt.Printf(" %12s", formatPercentile(p.Percentile)+"%")
+		}
+		fmt.Printf("\n")
+		for _, p := range s.Phases {
+			if p.Count == 0 {
+				continue
+			}
+
+			fmt.Printf("%8s %8d", p.Phase, p.Count)
+			for _, pp := range p.Latency.Percentiles {
+				fmt.Printf(" %12v", fromMilliseconds(pp.Latency))
+			}
+			fmt.Printf("\n")
+		}
+	}
+	if s.Connections.IdleTime.Max > 0 {
+		fmt.Printf("idle time of reused connections:\n")
+		for _, p := range s.Connections.IdleTime.Percentiles {
+			fmt.Printf("%6s %v\n", formatPercentile(p.Percentile)+"%", fromMilliseconds(p.Latency))
+		}
+	}
+	// With only one tag or remote the statistics are the same as the totals.
+	if len(s.Tags) > 1 {
+		names := make([]string, 0, len(s.Tags))
+		groups := make([]groupSummary, 0, len(s.Tags))
+		for _, t := range s.Tags {
+			names = append(names, t.Tag)
+			groups = append(groups, t.groupSummary)
+		}
+
+		fmt.Printf("tags:\n")
+		s.printGroups("tag", names, groups)
+	}
+	if len(s.Remotes) > 1 {
+		names := make([]string, 0, len(s.Remotes))
+		groups := make([]groupSummary, 0, len(s.Remotes))
+		for _, r := range s.Remotes {
+			names = append(names, r.Remote)
+			groups = append(groups, r.groupSummary)
+		}
+
+		fmt.Printf("remotes:\n")
+		s.printGroups("remote", names, groups)
+	}
+	if len(s.Thresholds) > 0 {
+		fmt.Printf("thresholds:\n")
+		for _, t := range s.Thresholds {
+			result := "pass"
+			if !t.Pass {
+				result = "FAIL"
+			}
+
+			fmt.Printf("  %s  %-24s %s\n", result, t.Threshold, t.formatted)
+		}
+	}
+}
+
+// printGroups prints a table with the statistics of groups of requests.
+func (s *summary) printGroups(column string, names []string, groups []groupSummary) {
+	width := len(column)
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	fmt.Printf("  %-*s %8s %8s %10s", width, column, "requests", "errors", "req/s")
+	for _, p := range s.Latency.Percentiles {
+		fmt.Printf(" %12s", formatPercentile(p.Percentile)+"%")
+	}
+	fmt.Printf("\n")
+	for i, g := range groups {
+		fmt.Printf("  %-*s %8d %8d %10.2f", width, names[i], g.Requests, g.Errors, g.RequestsPerSecond)
+		for _, p := range g.Latency.Percentiles {
+			fmt.Printf(" %12v", fromMilliseconds(p.Latency))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// write writes the summary to a file. Files ending in .csv are written as
+// CSV, all other files are written as JSON.
+func (s *summary) write(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(filepath.Ext(name)) == ".csv" {
+		err = s.writeCSV(f)
+	} else {
+		err = s.writeJSON(f)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (s *summary) writeJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+
+	return e.Encode(s)
+}
+
+// writeCSV writes a row for each sample followed by a row with the totals.
+func (s *summary) writeCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+
+	header := []string{"elapsed", "requests", "errors", "late", "dropped", "target", "min", "mean", "max"}
+	for _, p := range s.Latency.Percentiles {
+		header = append(header, "p"+formatPercentile(p.Percentile))
+	}
+
+	if err := c.Write(header); err != nil {
+		return err
+	}
+
+	row := func(elapsed string, requests, errors, late, dropped uint64, target string, l latency) []string {
+		r := []string{
+			elapsed,
+			strconv.FormatUint(requests, 10),
+			strconv.FormatUint(errors, 10),
+			strconv.FormatUint(late, 10),
+			strconv.FormatUint(dropped, 10),
+			target,
+			strconv.FormatFloat(l.Min, 'f', -1, 64),
+			strconv.FormatFloat(l.Mean, 'f', -1, 64),
+			strconv.FormatFloat(l.Max, 'f', -1, 64),
+		}
+
+		for _, p := range l.Percentiles {
+			r = append(r, strconv.FormatFloat(p.Latency, 'f', -1, 64))
+		}
+
+		return r
+	}
+
+	for _, sm := range s.Samples {
+		if err := c.Write(row(strconv.FormatFloat(sm.Elapsed, 'f', -1, 64), sm.Requests, sm.Errors, sm.Late, sm.Dropped, strconv.FormatFloat(sm.Target, 'f', -1, 64), sm.Latency)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Write(row("total", s.Requests, s.Errors, s.Late, s.Dropped, "", s.Latency)); err != nil {
+		return err
+	}
+
+	c.Flush()
+
+	return c.Error()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cjoudrey/gluahttp"
+	"github.com/yuin/gopher-lua"
+)
+
+// Scripts that define a scenario function run it as a coroutine for each
+// worker instead of calling the request function. The scenario performs its
+// requests using http.send which yields to the worker. The worker performs,
+// times and records the request like any other request without holding the
+// lock of the Lua state and resumes the scenario with the response.
+
+// What a scenario yields for.
+const (
+	yieldSend  = lua.LString("send")
+	yieldSleep = lua.LString("sleep")
+)
+
+// httpLoader loads the http module with http.send added. It's also
+// available as http['do'] as do is a Lua keyword.
+func httpLoader(L *lua.LState) int {
+	gluahttp.NewHttpModule(client).Loader(L)
+
+	mod := L.Get(-1).(*lua.LTable)
+	send := L.NewFunction(luaSend)
+	L.SetField(mod, "send", send)
+	L.SetField(mod, "do", send)
+
+	return 1
+}
+
+// luaSend performs a request from a scenario. The request is a table like the
+// ones returned by the request function. It returns the response table like
+// the one passed to the response function, or nil and the class of the error
+// when the request failed.
+func luaSend(L *lua.LState) int {
+	if L.Parent == nil {
+		L.RaiseError("http.send can only be used in a scenario")
+	}
+
+	req := L.CheckTable(1)
+
+	return L.Yield(yieldSend, req)
+}
+
+// luaSleep pauses a scenario for a number of seconds or a duration string
+// like '500ms' to simulate think time.
+func luaSleep(L *lua.LState) int {
+	if L.Parent == nil {
+		L.RaiseError("sleep can only be used in a scenario")
+	}
+
+	var d time.Duration
+
+	switch v := L.Get(1).(type) {
+	case lua.LNumber:
+		d = time.Duration(float64(v) * float64(time.Second))
+	case lua.LString:
+		var err error
+		if d, err = time.ParseDuration(string(v)); err != nil {
+			L.ArgError(1, err.Error())
+		}
+	default:
+		L.ArgError(1, "number of seconds or duration expected")
+	}
+
+	return L.Yield(yieldSleep, lua.LNumber(d))
+}
+
+// scenarioSuccess returns if a response of a scenario was a success. Without
+// a response function responses below 400 are successful.
+func scenarioSuccess(L *lua.LState, table *lua.LTable, status int, stateName string) bool {
+	if L.GetGlobal("response").Type() != lua.LTFunction {
+		return status < 400
+	}
+
+	return callResponse(L, table, stateName)
+}
+
+// runScenario runs the scenario once for worker n. It returns false when the
+// worker should stop. A run that didn't send a request still waits for its
+// turn so scenarios that return early don't keep the worker busy.
+func runScenario(n int, ls *luaState, stateName string) bool {
+	ls.Lock()
+
+	L := ls.L
+	co := L.NewThread()
+	fn := L.GetGlobal("scenario").(*lua.LFunction)
+	args := []lua.LValue{L.GetGlobal(stateName)}
+	sent := false
+
+	for {
+		called := time.Now()
+		st, err, values := L.Resume(co, fn, args...)
+		observeCallback("scenario", time.Since(called))
+
+		ls.Unlock()
+
+		if st == lua.ResumeError {
+			log.Fatal(err)
+		} else if st == lua.ResumeOK {
+			if !sent {
+				_, ok := waitTurn()
+				return ok
+			}
+
+			return true
+		}
+
+		args = nil
+
+		if len(values) == 0 || (values[0] != yieldSend && values[0] != yieldSleep) {
+			log.Fatal("a scenario can only yield using http.send and sleep")
+		}
+
+		switch values[0] {
+		case yieldSend:
+			sent = true
+
+			ls.Lock()
+			req := requestFromTable(ls, values[1].(*lua.LTable))
+			ls.Unlock()
+
+			intended, ok := waitTurn()
+			if !ok {
+				if req.Body != nil {
+					req.Body.Close()
+				}
+
+				return false
+			}
+
+			ok = perform(n, req, intended, func(r *result, res *http.Response, body []byte) {
+				ls.Lock()
+				defer ls.Unlock()
+
+				if res == nil {
+					args = []lua.LValue{lua.LNil, lua.LString(r.errorClass)}
+					return
+				}
+
+				table := responseTable(L, res, body, *r)
+				args = []lua.LValue{table}
+
+				if !scenarioSuccess(L, table, r.status, stateName) {
+					r.failed = true
+					r.errorClass = errorRejected
+				}
+			})
+			if !ok {
+				return false
+			}
+		case yieldSleep:
+			select {
+			case <-stop:
+				return false
+			case <-finishing:
+				return false
+			case <-time.After(time.Duration(values[1].(lua.LNumber))):
+			}
+		}
+
+		ls.Lock()
+	}
+}
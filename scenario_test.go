@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestScenarioYields(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	L.Register("sleep", luaSleep)
+	L.PreloadModule("http", httpLoader)
+
+	err := L.DoString(`
+		local http = require('http')
+
+		function scenario()
+			local res = http.send({ url = 'http://127.0.0.1/a' })
+			http['do']({ url = 'http://127.0.0.1/' .. res })
+			sleep('500ms')
+			sleep(0.25)
+		end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	co := L.NewThread()
+	fn := L.GetGlobal("scenario").(*lua.LFunction)
+
+	expected := []struct {
+		yield lua.LValue
+		value string
+	}{
+		{yieldSend, "http://127.0.0.1/a"},
+		{yieldSend, "http://127.0.0.1/b"},
+		{yieldSleep, lua.LNumber(500 * time.Millisecond).String()},
+		{yieldSleep, lua.LNumber(250 * time.Millisecond).String()},
+	}
+
+	args := []lua.LValue{}
+
+	for _, e := range expected {
+		st, err, values := L.Resume(co, fn, args...)
+		if st != lua.ResumeYield {
+			t.Fatalf("expected a yield not %v %v", st, err)
+		}
+
+		if values[0] != e.yield {
+			t.Fatalf("expected a %s yield not %s", e.yield, values[0])
+		}
+
+		value := values[1].String()
+		if req, ok := values[1].(*lua.LTable); ok {
+			value = req.RawGetString("url").String()
+		}
+
+		if value != e.value {
+			t.Fatalf("expected %s to yield %s not %s", e.yield, e.value, value)
+		}
+
+		// The response of the first request.
+		args = []lua.LValue{lua.LString("b")}
+	}
+
+	if st, err, _ := L.Resume(co, fn); st != lua.ResumeOK {
+		t.Fatalf("expected the scenario to be done not %v %v", st, err)
+	}
+
+	// Outside a scenario these can't be used.
+	for _, script := range []string{`sleep(1)`, `require('http').send({ url = 'http://127.0.0.1/' })`} {
+		if err := L.DoString(script); err == nil {
+			t.Fatalf("expected %s to fail outside a scenario", script)
+		}
+	}
+}
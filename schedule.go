@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Workers check the rate limiter at least this often so they pick up rate
+// changes made by load profiles.
+const maxWait = 100 * time.Millisecond
+
+// Requests that start more than lateThreshold after their intended start time
+// are counted as late in the open-loop model.
+const lateThreshold = time.Millisecond
+
+var (
+	// schedule receives the intended start times of requests when using the
+	// open-loop model. It is nil when using the closed-loop model.
+	schedule chan time.Time
+
+	lateN    = uint64(0)
+	droppedN = uint64(0)
+)
+
+// waitTurn blocks until the worker is allowed to perform its next request.
+// It returns the time the request was intended to start, which is the zero
+// time for the closed-loop model, and false when the worker should stop.
+func waitTurn() (time.Time, bool) {
+	if schedule != nil {
+		select {
+		case <-stop:
+			return time.Time{}, false
+		case <-finishing:
+			return time.Time{}, false
+		case intended := <-schedule:
+			return intended, true
+		}
+	}
+
+	for {
+		limit, sleep := rate.Try()
+		if !limit {
+			select {
+			case <-stop:
+				return time.Time{}, false
+			default:
+			}
+
+			return time.Time{}, true
+		}
+
+		if sleep > maxWait {
+			sleep = maxWait
+		}
+
+		select {
+		case <-stop:
+			return time.Time{}, false
+		case <-finishing:
+			return time.Time{}, false
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// dispatch schedules requests at fixed intervals starting at last for the
+// open-loop model. When all workers are busy and the schedule is full the
+// request is dropped.
+func dispatch(last time.Time) {
+	for {
+		interval := rate.Interval()
+		if interval == 0 {
+			// No requests are allowed right now, check again later.
+			select {
+			case <-stop:
+				return
+			case <-time.After(maxWait):
+			}
+
+			last = time.Now()
+			continue
+		}
+
+		next := last.Add(interval)
+
+		if wait := next.Sub(time.Now()); wait > 0 {
+			// Don't wait too long at once so rate changes are picked up.
+			if wait > maxWait {
+				wait = maxWait
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case schedule <- next:
+		default:
+			atomic.AddUint64(&droppedN, 1)
+		}
+
+		last = next
+	}
+}
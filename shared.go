@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// The shared module allows scripts to share values between Lua states.
+// Only immutable values (nil, booleans, numbers and strings) can be stored
+// so they can safely be passed between states.
+
+var (
+	sharedValues = make(map[string]lua.LValue, 0)
+	sharedLock   sync.Mutex
+)
+
+func sharedLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get": sharedGet,
+		"set": sharedSet,
+		"add": sharedAdd,
+	})
+
+	L.Push(mod)
+
+	return 1
+}
+
+func checkSharedValue(L *lua.LState, n int) lua.LValue {
+	value := L.Get(n)
+
+	switch value.Type() {
+	case lua.LTNil, lua.LTBool, lua.LTNumber, lua.LTString:
+		return value
+	}
+
+	L.ArgError(n, "only nil, boolean, number and string values can be shared")
+
+	return lua.LNil
+}
+
+func sharedGet(L *lua.LState) int {
+	key := L.CheckString(1)
+
+	sharedLock.Lock()
+	value, ok := sharedValues[key]
+	sharedLock.Unlock()
+
+	if !ok {
+		value = lua.LNil
+	}
+
+	L.Push(value)
+
+	return 1
+}
+
+func sharedSet(L *lua.LState) int {
+	key := L.CheckString(1)
+	value := checkSharedValue(L, 2)
+
+	sharedLock.Lock()
+	if value == lua.LNil {
+		delete(sharedValues, key)
+	} else {
+		sharedValues[key] = value
+	}
+	sharedLock.Unlock()
+
+	return 0
+}
+
+// sharedAdd atomically adds a number to a shared value and returns the result.
+// Values that don't exist yet start at 0.
+func sharedAdd(L *lua.LState) int {
+	key := L.CheckString(1)
+	delta := L.OptNumber(2, 1)
+
+	sharedLock.Lock()
+	old, ok := sharedValues[key]
+	value, isNumber := old.(lua.LNumber)
+	if ok && !isNumber {
+		sharedLock.Unlock()
+		L.RaiseError("shared value %s is not a number", key)
+		return 0
+	}
+	value += delta
+	sharedValues[key] = value
+	sharedLock.Unlock()
+
+	L.Push(value)
+
+	return 1
+}
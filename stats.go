@@ -0,0 +1,268 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erikdubbelboer/hench/internal/histogram"
+)
+
+// result is the outcome of a single request.
+type result struct {
+	// Only requests that got a response have a status, latency and phases.
+	response bool
+	status   int
+	proto    string
+	latency  time.Duration
+	phases   phases
+
+	// The number of bytes of the request body that were sent.
+	uploadBytes uint64
+
+	// If the request got a connection, if it was reused and how long it
+	// was idle before.
+	gotConn  bool
+	reused   bool
+	idleTime time.Duration
+
+	// The address of the server, which is also known for some errors like
+	// refused connections.
+	remoteAddr string
+
+	// Requests that performed a TLS handshake and if the session was resumed.
+	tlsHandshake bool
+	tlsResumed   bool
+
+	// HTTP/3 requests that opened a new connection and if it used 0-RTT.
+	quicHandshake bool
+	zeroRTT       bool
+
+	// A request failed when no response was received or when the response
+	// function of the script didn't return true. The class of the error is
+	// in errorClass.
+	failed     bool
+	errorClass string
+
+	// The statistics are also collected per tag.
+	tag string
+
+	// Requests during the warm-up are only part of the per second statistics.
+	warmup bool
+
+	// Requests that finished after the run was stopped are ignored.
+	stopped bool
+}
+
+// counters contains the counts of a set of results.
+type counters struct {
+	total        uint64
+	requests     uint64
+	errors       uint64
+	status       map[int]uint64
+	protos       map[string]uint64
+	errorClasses map[string]uint64
+
+	newConns       uint64
+	reusedConns    uint64
+	tlsHandshakes  uint64
+	tlsResumed     uint64
+	quicHandshakes uint64
+	zeroRTT        uint64
+	uploadBytes    uint64
+	uploadTime     time.Duration
+}
+
+func newCounters() counters {
+	return counters{
+		status:       make(map[int]uint64, 0),
+		protos:       make(map[string]uint64, 0),
+		errorClasses: make(map[string]uint64, 0),
+	}
+}
+
+func (c *counters) add(r result) {
+	c.total++
+	c.uploadBytes += r.uploadBytes
+	c.uploadTime += r.phases[phaseUpload]
+
+	if r.gotConn {
+		if r.reused {
+			c.reusedConns++
+		} else {
+			c.newConns++
+		}
+	}
+
+	if r.response {
+		c.requests++
+		c.status[r.status]++
+		c.protos[r.proto]++
+
+		if r.tlsHandshake {
+			c.tlsHandshakes++
+		}
+		if r.tlsResumed {
+			c.tlsResumed++
+		}
+		if r.quicHandshake {
+			c.quicHandshakes++
+		}
+		if r.zeroRTT {
+			c.zeroRTT++
+		}
+	}
+	if r.failed {
+		c.errors++
+		c.errorClasses[r.errorClass]++
+	}
+}
+
+// tagStats contains the statistics of all requests with the same tag or
+// with the same remote IP.
+type tagStats struct {
+	counters
+
+	latencies *histogram.Histogram
+}
+
+// stats collects the results of all requests and of the current second.
+type stats struct {
+	m         sync.Mutex
+	precision int
+
+	counters
+	second counters
+
+	latencies       *histogram.Histogram
+	secondLatencies *histogram.Histogram
+	phases          [numPhases]*histogram.Histogram
+	idleTimes       *histogram.Histogram
+	tags            map[string]*tagStats
+	remotes         map[string]*tagStats
+}
+
+func newLatencyHistogram(precision int) *histogram.Histogram {
+	return histogram.New(int64(time.Microsecond), int64(time.Hour), precision)
+}
+
+func newStats(precision int) *stats {
+	s := &stats{
+		precision:       precision,
+		counters:        newCounters(),
+		second:          newCounters(),
+		latencies:       newLatencyHistogram(precision),
+		secondLatencies: newLatencyHistogram(precision),
+		idleTimes:       newLatencyHistogram(precision),
+		tags:            make(map[string]*tagStats, 0),
+		remotes:         make(map[string]*tagStats, 0),
+	}
+
+	for i := range s.phases {
+		s.phases[i] = newLatencyHistogram(precision)
+	}
+
+	return s
+}
+
+func (s *stats) record(r result) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.second.add(r)
+	if r.response {
+		s.secondLatencies.Record(int64(r.latency))
+	}
+
+	if r.warmup {
+		return
+	}
+
+	s.counters.add(r)
+
+	if r.idleTime > 0 {
+		s.idleTimes.Record(int64(r.idleTime))
+	}
+
+	t := s.group(s.tags, r.tag)
+	t.add(r)
+
+	// Errors before a connection was dialed, like dns errors, don't have
+	// a remote address.
+	var remote *tagStats
+	if r.remoteAddr != "" {
+		remote = s.group(s.remotes, remoteIP(r.remoteAddr))
+		remote.add(r)
+	}
+
+	if !r.response {
+		return
+	}
+
+	s.latencies.Record(int64(r.latency))
+	t.latencies.Record(int64(r.latency))
+	if remote != nil {
+		remote.latencies.Record(int64(r.latency))
+	}
+
+	// Only record phases that happened so reused connections don't add
+	// lots of zero durations to the dns, connect and tls phases.
+	for i, d := range r.phases {
+		if d > 0 {
+			s.phases[i].Record(int64(d))
+		}
+	}
+}
+
+// group returns the statistics for a tag or remote IP.
+func (s *stats) group(groups map[string]*tagStats, name string) *tagStats {
+	if t, ok := groups[name]; ok {
+		return t
+	}
+
+	if len(groups) >= maxTags {
+		name = otherTag
+
+		if t, ok := groups[name]; ok {
+			return t
+		}
+	}
+
+	precision := s.precision
+	if precision > maxTagPrecision {
+		precision = maxTagPrecision
+	}
+
+	t := &tagStats{
+		counters:  newCounters(),
+		latencies: newLatencyHistogram(precision),
+	}
+
+	groups[name] = t
+
+	return t
+}
+
+// remoteIP returns the IP of a remote address without the port.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// takeSecond returns the counts and latencies recorded since the last call.
+func (s *stats) takeSecond() (counters, *histogram.Histogram) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	c := s.second
+	h := s.secondLatencies.Snapshot()
+
+	s.second = newCounters()
+	s.secondLatencies.Reset()
+
+	return c, h
+}
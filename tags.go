@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// To limit memory usage only this many different tags and remote IPs are
+// tracked. Requests with other tags or IPs are counted under otherTag.
+// Their latencies are recorded with at most maxTagPrecision significant
+// digits as a histogram with a precision of 5 takes about 17MB.
+const (
+	maxTags         = 100
+	maxTagPrecision = 3
+	otherTag        = "other"
+)
+
+// Path segments that look like identifiers are replaced by :id in the
+// default tag so requests for different objects are grouped together.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{16,}|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// defaultTag returns the tag for requests without a name or tag, which is
+// the method followed by the path template of the url.
+func defaultTag(method string, u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+
+	path := strings.Join(segments, "/")
+	if path == "" {
+		path = "/"
+	}
+
+	return method + " " + path
+}
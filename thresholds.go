@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/erikdubbelboer/hench/internal/threshold"
+	"github.com/yuin/gopher-lua"
+)
+
+// The exit code used when one or more thresholds are breached.
+const thresholdsFailedExitCode = 3
+
+type thresholdResult struct {
+	Threshold string  `json:"threshold"`
+	Value     float64 `json:"value"`
+	Pass      bool    `json:"pass"`
+
+	formatted string
+}
+
+// loadThresholds returns the thresholds to check. Thresholds passed using
+// -thresholds take precedence over the thresholds table of the script.
+func loadThresholds(list string, ls *luaState) ([]threshold.Threshold, error) {
+	if list != "" {
+		return threshold.ParseList(list)
+	}
+
+	ls.Lock()
+	defer ls.Unlock()
+
+	switch t := ls.L.GetGlobal("thresholds").(type) {
+	case *lua.LTable:
+		thresholds := make([]threshold.Threshold, 0, t.Len())
+
+		for i := 1; i <= t.Len(); i++ {
+			th, err := threshold.Parse(lua.LVAsString(t.RawGetInt(i)))
+			if err != nil {
+				return nil, err
+			}
+
+			thresholds = append(thresholds, th)
+		}
+
+		return thresholds, nil
+	case *lua.LNilType:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("thresholds should be a table not a %s", t.Type())
+	}
+}
+
+// metric returns the value of a metric of the final statistics.
+func metric(th threshold.Threshold, sum *summary, st *stats) float64 {
+	if p, ok := th.Percentile(); ok {
+		return milliseconds(st.latencies.Quantile(p / 100))
+	}
+
+	switch th.Metric {
+	case "min":
+		return sum.Latency.Min
+	case "mean":
+		return sum.Latency.Mean
+	case "max":
+		return sum.Latency.Max
+	case "error_rate":
+		if st.total == 0 {
+			return 0
+		}
+
+		return float64(st.errors) / float64(st.total)
+	case "rps":
+		return sum.RequestsPerSecond
+	case "requests":
+		return float64(sum.Requests)
+	case "errors":
+		return float64(sum.Errors)
+	case "late":
+		return float64(sum.Late)
+	case "dropped":
+		return float64(sum.Dropped)
+	}
+
+	return 0
+}
+
+func checkThresholds(thresholds []threshold.Threshold, sum *summary, st *stats) []thresholdResult {
+	results := make([]thresholdResult, 0, len(thresholds))
+
+	for _, th := range thresholds {
+		// Without responses there are no latencies to check.
+		if th.Kind() == threshold.Latency && st.latencies.Count() == 0 {
+			results = append(results, thresholdResult{
+				Threshold: th.String(),
+				formatted: "no responses",
+			})
+
+			continue
+		}
+
+		v := metric(th, sum, st)
+
+		results = append(results, thresholdResult{
+			Threshold: th.String(),
+			Value:     v,
+			Pass:      th.Check(v),
+			formatted: th.Format(v),
+		})
+	}
+
+	return results
+}
+
+// thresholdsPassed returns false if any of the thresholds was breached.
+func thresholdsPassed(results []thresholdResult) bool {
+	for _, r := range results {
+		if !r.Pass {
+			return false
+		}
+	}
+
+	return true
+}
+
+// finish checks the thresholds, prints and writes the summary and exits with
+// thresholdsFailedExitCode when a threshold was breached.
+func finish(sum *summary, st *stats, thresholds []threshold.Threshold, output string) {
+	sum.Thresholds = checkThresholds(thresholds, sum, st)
+
+	sum.print()
+
+	if output != "" {
+		if err := sum.write(output); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !thresholdsPassed(sum.Thresholds) {
+		os.Exit(thresholdsFailedExitCode)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// tlsOptions contains the TLS settings that can be set using flags or using
+// the tls table of the script.
+type tlsOptions struct {
+	cert       string
+	key        string
+	ca         string
+	insecure   bool
+	serverName string
+	minVersion string
+	maxVersion string
+	ciphers    string
+	resumption bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig returns the TLS configuration to use. Flags that are set
+// take precedence over the tls table of the script.
+func loadTLSConfig(flags tlsOptions, set map[string]bool, ls *luaState) (*tls.Config, error) {
+	opts, err := luaTLSOptions(ls)
+	if err != nil {
+		return nil, err
+	}
+
+	if set["cert"] {
+		opts.cert = flags.cert
+	}
+	if set["key"] {
+		opts.key = flags.key
+	}
+	if set["cacert"] {
+		opts.ca = flags.ca
+	}
+	if set["insecure"] {
+		opts.insecure = flags.insecure
+	}
+	if set["servername"] {
+		opts.serverName = flags.serverName
+	}
+	if set["tlsmin"] {
+		opts.minVersion = flags.minVersion
+	}
+	if set["tlsmax"] {
+		opts.maxVersion = flags.maxVersion
+	}
+	if set["ciphers"] {
+		opts.ciphers = flags.ciphers
+	}
+	if set["tlsresume"] {
+		opts.resumption = flags.resumption
+	}
+
+	return opts.config()
+}
+
+// luaTLSOptions reads the tls table of the script, for example:
+//
+//	tls = {
+//	  ['cert']        = 'client.pem',
+//	  ['key']         = 'client.key',
+//	  ['ca']          = 'ca.pem',
+//	  ['insecure']    = false,
+//	  ['server_name'] = 'example.com',
+//	  ['min_version'] = '1.2',
+//	  ['max_version'] = '1.3',
+//	  ['ciphers']     = 'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256',
+//	  ['resumption']  = true
+//	}
+func luaTLSOptions(ls *luaState) (tlsOptions, error) {
+	opts := tlsOptions{
+		resumption: true,
+	}
+
+	ls.Lock()
+	defer ls.Unlock()
+
+	switch t := ls.L.GetGlobal("tls").(type) {
+	case *lua.LTable:
+		str := func(name string) string {
+			if v := t.RawGetString(name); v.Type() != lua.LTNil {
+				return lua.LVAsString(v)
+			}
+
+			return ""
+		}
+
+		opts.cert = str("cert")
+		opts.key = str("key")
+		opts.ca = str("ca")
+		opts.insecure = lua.LVAsBool(t.RawGetString("insecure"))
+		opts.serverName = str("server_name")
+		opts.minVersion = str("min_version")
+		opts.maxVersion = str("max_version")
+
+		switch c := t.RawGetString("ciphers").(type) {
+		case *lua.LTable:
+			ciphers := make([]string, 0, c.Len())
+			for i := 1; i <= c.Len(); i++ {
+				ciphers = append(ciphers, lua.LVAsString(c.RawGetInt(i)))
+			}
+
+			opts.ciphers = strings.Join(ciphers, ",")
+		default:
+			opts.ciphers = str("ciphers")
+		}
+
+		if r := t.RawGetString("resumption"); r.Type() != lua.LTNil {
+			opts.resumption = lua.LVAsBool(r)
+		}
+
+		return opts, nil
+	case *lua.LNilType:
+		return opts, nil
+	default:
+		return opts, fmt.Errorf("tls should be a table not a %s", t.Type())
+	}
+}
+
+func (opts tlsOptions) config() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: opts.insecure,
+		ServerName:         opts.serverName,
+	}
+
+	if opts.cert != "" || opts.key != "" {
+		// The key can be in the same file as the certificate.
+		key := opts.key
+		if key == "" {
+			key = opts.cert
+		}
+
+		cert, err := tls.LoadX509KeyPair(opts.cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.ca != "" {
+		pem, err := ioutil.ReadFile(opts.ca)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.ca)
+		}
+	}
+
+	var err error
+
+	if c.MinVersion, err = tlsVersion(opts.minVersion); err != nil {
+		return nil, err
+	}
+	if c.MaxVersion, err = tlsVersion(opts.maxVersion); err != nil {
+		return nil, err
+	}
+
+	if c.CipherSuites, err = cipherSuites(opts.ciphers); err != nil {
+		return nil, err
+	}
+
+	if opts.resumption {
+		c.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	} else {
+		c.SessionTicketsDisabled = true
+	}
+
+	return c, nil
+}
+
+// tlsVersion returns the TLS version for a version like 1.2 and 0 when no
+// version is given.
+func tlsVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version: %s", version)
+}
+
+// cipherSuites returns the ids of a comma separated list of cipher suite
+// names. It returns nil when the list is empty so the default is used.
+// TLS 1.3 cipher suites can't be configured.
+func cipherSuites(list string) ([]uint16, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	ids := make(map[string]uint16, 0)
+
+	for _, s := range tls.CipherSuites() {
+		ids[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		ids[s.Name] = s.ID
+	}
+
+	suites := make([]uint16, 0)
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
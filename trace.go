@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/yuin/gopher-lua"
+)
+
+// The phases of a request that are timed.
+const (
+	phaseDNS = iota
+	phaseConnect
+	phaseTLS
+	phaseQUIC
+	phaseUpload
+	phaseTTFB
+	phaseBody
+
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"dns", "connect", "tls", "quic", "upload", "ttfb", "body"}
+
+// phases contains the duration of each phase of a request.
+// Phases that didn't happen, for example dns lookups on a reused connection,
+// have a duration of 0.
+type phases [numPhases]time.Duration
+
+// requestTrace records when each phase of a request starts and ends.
+//
+// When a request gets an idle connection while a new connection is being
+// dialed for it, the dial continues in the background and calls the hooks
+// of the request after it got its connection. These calls are ignored and
+// the lock protects the trace against them.
+type requestTrace struct {
+	m sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	tlsOK        bool
+	tlsResumed   bool
+	quicStart    time.Time
+	quicDone     time.Time
+	wroteHeaders time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	headers      time.Time
+	done         time.Time
+
+	// The address that was dialed and the address of the connection that
+	// was used. The dialed address is known even when the connection failed.
+	dialAddr string
+	connAddr string
+
+	// If a connection was used, if it was reused and how long it was idle.
+	gotConn  bool
+	reused   bool
+	idleTime time.Duration
+
+	// The HTTP/3 connection opened for this request, if any.
+	quicConn *quic.Conn
+
+	// The request body is counted while it's sent. Files are passed to the
+	// transport as they are so it can use sendfile, only their size is known.
+	upload   *uploadBody
+	fileSize int64
+}
+
+type requestTraceKey struct{}
+
+// withRequestTrace returns a context that carries the trace so the HTTP/3
+// dialer can record the QUIC handshake.
+func withRequestTrace(ctx context.Context, t *requestTrace) context.Context {
+	return context.WithValue(ctx, requestTraceKey{}, t)
+}
+
+func requestTraceFromContext(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(requestTraceKey{}).(*requestTrace)
+	return t
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.dial(func() {
+				t.dnsStart = time.Now()
+			})
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.dial(func() {
+				t.dnsDone = time.Now()
+			})
+		},
+		ConnectStart: func(network, addr string) {
+			// With multiple addresses only the last connection attempt is timed.
+			t.dial(func() {
+				t.connectStart = time.Now()
+				t.dialAddr = addr
+			})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.dial(func() {
+				t.connectDone = time.Now()
+			})
+		},
+		TLSHandshakeStart: func() {
+			t.dial(func() {
+				t.tlsStart = time.Now()
+			})
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.dial(func() {
+				t.tlsDone = time.Now()
+				t.tlsOK = err == nil
+				t.tlsResumed = state.DidResume
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.m.Lock()
+			defer t.m.Unlock()
+
+			t.connAddr = info.Conn.RemoteAddr().String()
+			t.gotConn = true
+			t.reused = info.Reused
+
+			// HTTP/3 only reports a connection as reused when its handshake
+			// is complete. Requests that didn't dial the QUIC connection
+			// themselves, like requests that waited for the dial of another
+			// request, reused it.
+			if info.Conn.RemoteAddr().Network() == "udp" {
+				t.reused = t.quicStart.IsZero()
+			}
+			if info.WasIdle {
+				t.idleTime = info.IdleTime
+			}
+		},
+		WroteHeaders: func() {
+			t.m.Lock()
+			defer t.m.Unlock()
+
+			t.wroteHeaders = time.Now()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			t.m.Lock()
+			defer t.m.Unlock()
+
+			if info.Err == nil {
+				t.wroteRequest = time.Now()
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.m.Lock()
+			defer t.m.Unlock()
+
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+// dial records an event of dialing a connection unless the request already
+// got its connection.
+func (t *requestTrace) dial(record func()) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if !t.gotConn {
+		record()
+	}
+}
+
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
+
+// zeroRTT returns true if the request opened an HTTP/3 connection that
+// used 0-RTT.
+func (t *requestTrace) zeroRTT() bool {
+	if t.quicConn == nil {
+		return false
+	}
+
+	select {
+	case <-t.quicConn.HandshakeComplete():
+		return t.quicConn.ConnectionState().Used0RTT
+	default:
+		return false
+	}
+}
+
+// remoteAddr returns the address of the connection used for the request or
+// the address that was dialed when no connection was made.
+func (t *requestTrace) remoteAddr() string {
+	if t.connAddr != "" {
+		return t.connAddr
+	}
+
+	return t.dialAddr
+}
+
+// tlsHandshake returns true if the request performed a TLS handshake,
+// including the handshake of a new HTTP/3 connection, and if the handshake
+// resumed a previous session.
+func (t *requestTrace) tlsHandshake() (bool, bool) {
+	if t.quicConn == nil {
+		return t.tlsOK, t.tlsResumed
+	}
+
+	select {
+	case <-t.quicConn.HandshakeComplete():
+		return true, t.quicConn.ConnectionState().TLS.DidResume
+	default:
+		return true, false
+	}
+}
+
+// hasBody returns true if the request has a body to upload.
+func (t *requestTrace) hasBody() bool {
+	return t.upload != nil || t.fileSize > 0
+}
+
+// uploaded returns the number of bytes of the request body that were sent.
+// Files only count when the whole request was written.
+func (t *requestTrace) uploaded() uint64 {
+	if t.upload != nil {
+		return t.upload.sent()
+	}
+	if !t.wroteRequest.IsZero() {
+		return uint64(t.fileSize)
+	}
+
+	return 0
+}
+
+// phases returns the durations of the phases of the request.
+// The time to first byte is measured from the start of the request, the
+// body phase from the moment the headers are received. The upload phase is
+// the time between writing the headers and the end of the request body.
+func (t *requestTrace) phases() phases {
+	p := phases{
+		phaseDNS:     between(t.dnsStart, t.dnsDone),
+		phaseConnect: between(t.connectStart, t.connectDone),
+		phaseTLS:     between(t.tlsStart, t.tlsDone),
+		phaseQUIC:    between(t.quicStart, t.quicDone),
+		phaseTTFB:    between(t.start, t.firstByte),
+		phaseBody:    between(t.headers, t.done),
+	}
+
+	if t.hasBody() {
+		p[phaseUpload] = between(t.wroteHeaders, t.wroteRequest)
+	}
+
+	return p
+}
+
+// fill sets the connection, phases, upload and handshakes of the request
+// in r.
+func (t *requestTrace) fill(r *result) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// A connection that was still being dialed when the request got an idle
+	// connection isn't used by the request.
+	if t.reused {
+		t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+		t.connectStart, t.connectDone = time.Time{}, time.Time{}
+		t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+		t.tlsOK, t.tlsResumed = false, false
+	}
+
+	r.remoteAddr = t.remoteAddr()
+	r.gotConn, r.reused, r.idleTime = t.gotConn, t.reused, t.idleTime
+	r.phases = t.phases()
+	r.uploadBytes = t.uploaded()
+	r.tlsHandshake, r.tlsResumed = t.tlsHandshake()
+	r.quicHandshake = t.quicConn != nil
+	r.zeroRTT = t.zeroRTT()
+}
+
+// luaTable returns the phases as a table with the durations in milliseconds.
+func (p phases) luaTable(L *lua.LState) *lua.LTable {
+	table := L.CreateTable(0, numPhases)
+
+	for i, d := range p {
+		table.RawSetString(phaseNames[i], lua.LNumber(milliseconds(int64(d))))
+	}
+
+	return table
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// setProtocols configures which protocols the transport uses:
+//
+//	http1: HTTP/1.1 only.
+//	h2:    HTTP/2 over TLS only.
+//	h2c:   HTTP/2 without TLS (prior knowledge) only.
+//	auto:  HTTP/2 when negotiated using TLS ALPN, HTTP/1.1 otherwise.
+//
+// HTTP/3 uses a different transport, see newHTTP3Transport.
+func setProtocols(t *http.Transport, proto string, strict bool) error {
+	p := new(http.Protocols)
+
+	switch proto {
+	case "http1":
+		p.SetHTTP1(true)
+	case "h2":
+		p.SetHTTP2(true)
+	case "h2c":
+		p.SetUnencryptedHTTP2(true)
+	case "auto":
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+	default:
+		return fmt.Errorf("unknown protocol: %s", proto)
+	}
+
+	t.Protocols = p
+	t.HTTP2 = &http.HTTP2Config{
+		// When not strict new connections are opened when the stream limit of
+		// the server is reached on all existing connections.
+		StrictMaxConcurrentRequests: strict,
+	}
+
+	return nil
+}
+
+// streamLimit limits the number of concurrent requests per host. With HTTP/2
+// these are the streams over all connections to the host. The HTTP/2
+// transport only limits streams using the limit of the server.
+type streamLimit struct {
+	http.RoundTripper
+	n int
+
+	m     sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newStreamLimit(rt http.RoundTripper, n int) *streamLimit {
+	return &streamLimit{
+		RoundTripper: rt,
+		n:            n,
+		hosts:        make(map[string]chan struct{}, 0),
+	}
+}
+
+func (l *streamLimit) host(host string) chan struct{} {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.n)
+		l.hosts[host] = sem
+	}
+
+	return sem
+}
+
+// RoundTrip waits for a free stream. The stream is free again when the
+// response body is closed.
+func (l *streamLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	sem := l.host(req.URL.Host)
+
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, context.Cause(req.Context())
+	}
+
+	res, err := l.RoundTripper.RoundTrip(req)
+	if err != nil {
+		<-sem
+		return nil, err
+	}
+
+	res.Body = &releaseBody{ReadCloser: res.Body, sem: sem}
+
+	return res, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		<-b.sem
+	})
+	return err
+}
+
+// newHTTP3Transport returns a transport that uses HTTP/3 over QUIC.
+// New connections can use 0-RTT when the TLS config has a session cache.
+// Without keepalive every request uses a new connection.
+func newHTTP3Transport(tlsConfig *tls.Config, keepalive, compression bool) http.RoundTripper {
+	newTransport := func() *http3.Transport {
+		return &http3.Transport{
+			TLSClientConfig:    tlsConfig,
+			DisableCompression: !compression,
+			Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+				// Resolving with the context of the request makes sure the
+				// lookup is traced.
+				addr, err := resolveAddr(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				t := requestTraceFromContext(ctx)
+				if t != nil {
+					t.dial(func() {
+						t.quicStart = time.Now()
+						t.dialAddr = addr
+					})
+				}
+
+				// When 0-RTT is possible the connection is returned before the
+				// handshake is complete. The quic phase is the time until the
+				// request can be sent.
+				conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+				if err != nil {
+					return nil, err
+				}
+
+				if t != nil {
+					t.dial(func() {
+						t.quicDone = time.Now()
+						t.quicConn = conn
+					})
+				}
+
+				return conn, nil
+			},
+		}
+	}
+
+	if keepalive {
+		return newTransport()
+	}
+
+	return http3NoKeepalive(newTransport)
+}
+
+// http3NoKeepalive performs each request using a new transport which is
+// closed together with the response body.
+type http3NoKeepalive func() *http3.Transport
+
+func (newTransport http3NoKeepalive) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := newTransport()
+
+	res, err := t.RoundTrip(req)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	res.Body = &closeTransportBody{ReadCloser: res.Body, t: t}
+
+	return res, nil
+}
+
+type closeTransportBody struct {
+	io.ReadCloser
+	t *http3.Transport
+}
+
+func (b *closeTransportBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.t.Close()
+	return err
+}
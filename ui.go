@@ -0,0 +1,172 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+//go:embed ui.html
+var dashboardPage []byte
+
+// dashboard serves a page with live charts of the run and controls to change
+// the rate or stop the run.
+type dashboard struct {
+	m       sync.Mutex
+	samples []sample
+	stopped bool
+
+	// A load profile sets the rate itself so it can't be changed.
+	profile bool
+
+	setRate func(rps float64)
+	stop    func()
+}
+
+// dashboardState is polled by the page.
+type dashboardState struct {
+	Profile bool     `json:"profile"`
+	Stopped bool     `json:"stopped"`
+	Samples []sample `json:"samples"`
+}
+
+// startDashboard serves the dashboard on addr.
+func startDashboard(addr string, d *dashboard) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveIndex)
+	mux.HandleFunc("/samples", d.serveSamples)
+	mux.HandleFunc("/rate", d.serveRate)
+	mux.HandleFunc("/stop", d.serveStop)
+
+	fmt.Printf("dashboard running on http://%s/\n", l.Addr())
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Print(err)
+		}
+	}()
+}
+
+// add adds the sample of the last second.
+func (d *dashboard) add(s sample) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.samples = append(d.samples, s)
+}
+
+// finish marks the run as stopped.
+func (d *dashboard) finish() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.stopped = true
+}
+
+func (d *dashboard) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// serveSamples returns the samples starting at the from parameter so the page
+// only has to fetch the new ones.
+func (d *dashboard) serveSamples(w http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.Atoi(r.FormValue("from"))
+
+	d.m.Lock()
+	if from < 0 || from > len(d.samples) {
+		from = 0
+	}
+
+	state := dashboardState{
+		Profile: d.profile,
+		Stopped: d.stopped,
+		Samples: d.samples[from:],
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(state)
+	d.m.Unlock()
+
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// control returns true if r is a request of the page to control the run.
+// Other sites can't send requests with a JSON body without a preflight
+// request which is refused, and browsers send the origin of the page.
+func control(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return false
+		}
+	}
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "the body should be JSON", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	return true
+}
+
+// rateRequest is the body of a request to change the rate.
+type rateRequest struct {
+	RPS *float64 `json:"rps"`
+}
+
+func (d *dashboard) serveRate(w http.ResponseWriter, r *http.Request) {
+	if !control(w, r) {
+		return
+	}
+
+	if d.profile {
+		http.Error(w, "the rate is set by the load profile", http.StatusConflict)
+		return
+	}
+
+	var req rateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RPS == nil || *req.RPS < 0 {
+		http.Error(w, "invalid rps", http.StatusBadRequest)
+		return
+	}
+
+	d.setRate(*req.RPS)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *dashboard) serveStop(w http.ResponseWriter, r *http.Request) {
+	if !control(w, r) {
+		return
+	}
+
+	d.stop()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Request bodies don't have to be strings in the Lua state. A body_file is
+// streamed from disk, a multipart body is written while it's sent and a
+// body function is called for each chunk of a chunked body.
+
+// uploadBody counts the bytes of a request body that are sent.
+type uploadBody struct {
+	io.ReadCloser
+
+	n uint64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddUint64(&b.n, uint64(n))
+
+	return n, err
+}
+
+// sent returns the number of bytes that were sent.
+func (b *uploadBody) sent() uint64 {
+	return atomic.LoadUint64(&b.n)
+}
+
+// bodyGenerator reads a chunked body from a Lua function. The function is
+// called without arguments and returns the next chunk or nil at the end.
+type bodyGenerator struct {
+	ls  *luaState
+	fn  *lua.LFunction
+	buf []byte
+	eof bool
+}
+
+func (g *bodyGenerator) Read(p []byte) (int, error) {
+	for len(g.buf) == 0 {
+		if g.eof {
+			return 0, io.EOF
+		}
+
+		g.ls.Lock()
+		called := time.Now()
+		err := g.ls.L.CallByParam(lua.P{
+			Fn:      g.fn,
+			NRet:    1,
+			Protect: true,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		observeCallback("body", time.Since(called))
+
+		chunk := g.ls.L.Get(-1)
+		g.ls.L.Pop(1)
+		g.ls.Unlock()
+
+		switch chunk.Type() {
+		case lua.LTNil:
+			g.eof = true
+		case lua.LTString, lua.LTNumber:
+			g.buf = []byte(chunk.String())
+		default:
+			log.Fatalf("body function returned a %s instead of a string", chunk.Type())
+		}
+	}
+
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+
+	return n, nil
+}
+
+// multipartPart is a field or file of a multipart body.
+type multipartPart struct {
+	name        string
+	value       string
+	file        string
+	filename    string
+	contentType string
+}
+
+// multipartParts reads the parts from a table like:
+//
+//	{
+//	  { name = 'title', value = 'hello' },
+//	  { name = 'upload', file = 'big.bin', content_type = 'application/octet-stream' },
+//	}
+func multipartParts(table *lua.LTable) []multipartPart {
+	parts := make([]multipartPart, 0, table.Len())
+
+	table.ForEach(func(_, value lua.LValue) {
+		t, ok := value.(*lua.LTable)
+		if !ok {
+			log.Fatalf("multipart parts should be tables, not %s", value.Type())
+		}
+
+		p := multipartPart{
+			name:        lua.LVAsString(t.RawGetString("name")),
+			value:       lua.LVAsString(t.RawGetString("value")),
+			file:        lua.LVAsString(t.RawGetString("file")),
+			filename:    lua.LVAsString(t.RawGetString("filename")),
+			contentType: lua.LVAsString(t.RawGetString("content_type")),
+		}
+
+		if p.name == "" {
+			log.Fatal("multipart parts need a name")
+		}
+
+		if p.file != "" {
+			if _, err := os.Stat(p.file); err != nil {
+				log.Fatal(err)
+			}
+
+			if p.filename == "" {
+				p.filename = filepath.Base(p.file)
+			}
+			if p.contentType == "" {
+				p.contentType = "application/octet-stream"
+			}
+		}
+
+		parts = append(parts, p)
+	})
+
+	return parts
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// multipartBody sets a body on req that writes the parts while it's read
+// and returns its content type with the boundary. The parts are written
+// again with the same boundary when the body is needed for a redirect or
+// retry.
+func multipartBody(req *http.Request, parts []multipartPart) string {
+	boundary := multipart.NewWriter(nil).Boundary()
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return nil, err
+		}
+
+		go func() {
+			w.CloseWithError(writeMultipart(mw, parts))
+		}()
+
+		return r, nil
+	}
+
+	req.Body, _ = req.GetBody()
+
+	return "multipart/form-data; boundary=" + boundary
+}
+
+func writeMultipart(mw *multipart.Writer, parts []multipartPart) error {
+	for _, p := range parts {
+		if p.file == "" {
+			if err := mw.WriteField(p.name, p.value); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(p.name), quoteEscaper.Replace(p.filename)))
+		h.Set("Content-Type", p.contentType)
+
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p.file)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(pw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// fileBody opens a file to stream as the body of req. The file is opened
+// again when the body is needed for a redirect or retry.
+func fileBody(req *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if info.Size() == 0 {
+		f.Close()
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		return
+	}
+
+	req.Body = f
+	req.ContentLength = info.Size()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+}
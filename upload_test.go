@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestMultipartBody(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "upload.bin")
+	if err := ioutil.WriteFile(name, []byte("file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "http://127.0.0.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentType := multipartBody(req, []multipartPart{
+		{name: "title", value: "hello"},
+		{name: "upload", file: name, filename: `a "b".bin`, contentType: "application/octet-stream"},
+	})
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body is written again with the same boundary for redirects.
+	body, err := req.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first) != string(second) {
+		t.Fatalf("expected the same body twice not:\n%s\n%s", first, second)
+	}
+
+	r := multipart.NewReader(strings.NewReader(string(first)), params["boundary"])
+
+	expected := []struct {
+		name        string
+		filename    string
+		contentType string
+		value       string
+	}{
+		{"title", "", "", "hello"},
+		{"upload", `a "b".bin`, "application/octet-stream", "file contents"},
+	}
+
+	for _, e := range expected {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.FormName() != e.name || p.FileName() != e.filename || string(value) != e.value {
+			t.Fatalf("expected part %s %q %q not %s %q %q", e.name, e.filename, e.value, p.FormName(), p.FileName(), value)
+		}
+		if e.contentType != "" && p.Header.Get("Content-Type") != e.contentType {
+			t.Fatalf("expected %s to be %s not %s", e.name, e.contentType, p.Header.Get("Content-Type"))
+		}
+	}
+
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Fatalf("expected 2 parts not %v", err)
+	}
+}
+
+func TestFileBody(t *testing.T) {
+	dir := t.TempDir()
+
+	name := filepath.Join(dir, "upload.bin")
+	if err := ioutil.WriteFile(name, []byte("file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "http://127.0.0.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileBody(req, name)
+	defer req.Body.Close()
+
+	if req.ContentLength != 13 {
+		t.Fatalf("expected a length of 13 not %d", req.ContentLength)
+	}
+
+	for _, body := range []func() (io.ReadCloser, error){
+		func() (io.ReadCloser, error) { return req.Body, nil },
+		req.GetBody,
+	} {
+		b, err := body()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := ioutil.ReadAll(b)
+		b.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(contents) != "file contents" {
+			t.Fatalf("expected the file contents not %q", contents)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.bin")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileBody(req, empty)
+
+	if req.Body != http.NoBody || req.ContentLength != 0 {
+		t.Fatalf("expected no body for an empty file not %d bytes", req.ContentLength)
+	}
+}
+
+func TestBodyGenerator(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	err := L.DoString(`
+		local i = 0
+		function body()
+			i = i + 1
+			if i > 3 then return nil end
+			return string.rep('x', i)
+		end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &bodyGenerator{
+		ls: &luaState{L: L},
+		fn: L.GetGlobal("body").(*lua.LFunction),
+	}
+
+	b := &uploadBody{ReadCloser: ioutil.NopCloser(g)}
+
+	contents, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "xxxxxx" {
+		t.Fatalf("expected xxxxxx not %q", contents)
+	}
+	if b.sent() != 6 {
+		t.Fatalf("expected 6 bytes to be sent not %d", b.sent())
+	}
+}